@@ -1,72 +1,234 @@
 package chain
 
 import (
+	"bytes"
+	"encoding/binary"
+	"github.com/zbo14/pos/merkle"
 	. "github.com/zbo14/pos/util"
 	"os"
 )
 
+// Blocks are stored as length-prefixed records
+// record = length (8 bytes, big endian) | serialized block | hash(serialized block)
+// The offsets of records are not stored, the index is rebuilt
+// by scanning the file when a chain is opened, and each block
+// must link to the hash of the block before it. A last record
+// that is incomplete or has a bad checksum was torn by a crash
+// during a write, it is truncated from the file. A bad checksum
+// in any other record is an error.
+
+const RECORD_OVERHEAD = 8 + HASH_SIZE
+
+var (
+	ErrBlockNotFound  = Error("Block not found")
+	ErrChainCorrupted = Error("Chain has a corrupted block record")
+)
+
 type Chain struct {
-	ends Int64s
-	file *os.File
+	blocks    *merkle.Accumulator
+	ends      Int64s // end offset of each record
+	file      *os.File
+	hashes    map[string]int
+	last      *Block
+	truncated int64
 }
 
+func newChain(file *os.File) *Chain {
+	return &Chain{
+		blocks: merkle.NewAccumulator(),
+		file:   file,
+		hashes: make(map[string]int),
+	}
+}
+
+// Creates a new chain, truncating any existing file
 func NewChain(chainPath string) *Chain {
 	file := MustCreateFile(chainPath)
-	return &Chain{
-		file: file,
+	return newChain(file)
+}
+
+// Opens the chain at path, or creates it if it does not exist
+func OpenChain(chainPath string) (*Chain, error) {
+	file, err := os.OpenFile(chainPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := newChain(file)
+	if err = c.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func MustOpenChain(chainPath string) *Chain {
+	c, err := OpenChain(chainPath)
+	Check(err)
+	return c
+}
+
+func (c *Chain) Close() error {
+	return c.file.Close()
+}
+
+func checksum(data []byte) []byte {
+	hash := NewHash()
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+// Scans records and rebuilds the index
+func (c *Chain) load() error {
+	stat, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	var begin int64
+	for begin < size {
+		data, end, err := c.readRecord(begin, size)
+		if err == errTornRecord {
+			break
+		} else if err == ErrChainCorrupted && end == size {
+			// the last record was not fully written
+			break
+		} else if err != nil {
+			return err
+		}
+		b := new(Block)
+		UnmarshalJSON(data, b)
+		if err = CheckLink(c.last, b); err != nil {
+			return err
+		}
+		c.index(b, data, end)
+		begin = end
+	}
+	if begin == size {
+		return nil
+	}
+	if err = c.file.Truncate(begin); err != nil {
+		return err
+	}
+	c.truncated = size - begin
+	return c.file.Sync()
+}
+
+var errTornRecord = Error("Record extends past the end of the chain")
+
+// Reads the record at begin and returns its end offset
+func (c *Chain) readRecord(begin, size int64) ([]byte, int64, error) {
+	if begin+RECORD_OVERHEAD > size {
+		return nil, 0, errTornRecord
+	}
+	prefix := make([]byte, 8)
+	if _, err := c.file.ReadAt(prefix, begin); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint64(prefix))
+	if length < 0 || length > size-begin-RECORD_OVERHEAD {
+		return nil, 0, errTornRecord
 	}
+	end := begin + length + RECORD_OVERHEAD
+	buf := make([]byte, length+HASH_SIZE)
+	if _, err := c.file.ReadAt(buf, begin+8); err != nil {
+		return nil, end, err
+	}
+	data, sum := buf[:length], buf[length:]
+	if !bytes.Equal(sum, checksum(data)) {
+		return nil, end, ErrChainCorrupted
+	}
+	return data, end, nil
+}
+
+func (c *Chain) index(b *Block, data []byte, end int64) {
+	c.hashes[string(b.Hash())] = len(c.ends)
+	c.ends = append(c.ends, end)
+	c.blocks.Append(data)
+	c.last = b
+}
+
+// Number of bytes truncated from a torn write when the chain was opened
+func (c *Chain) Truncated() int64 {
+	return c.truncated
+}
+
+// Number of blocks in the chain
+func (c *Chain) Height() int {
+	return len(c.ends)
 }
 
 func (c *Chain) Last() int {
 	return len(c.ends) - 1
 }
 
+func (c *Chain) end() int64 {
+	if n := len(c.ends); n > 0 {
+		return c.ends[n-1]
+	}
+	return 0
+}
+
+// The block must link to the last block in the chain
 func (c *Chain) Write(b *Block) error {
+	if err := CheckLink(c.last, b); err != nil {
+		return err
+	}
 	data := b.Serialize()
-	n, err := c.file.Write(data)
+	record := make([]byte, 8, len(data)+RECORD_OVERHEAD)
+	binary.BigEndian.PutUint64(record, uint64(len(data)))
+	record = append(record, data...)
+	record = append(record, checksum(data)...)
+	begin := c.end()
+	n, err := c.file.WriteAt(record, begin)
 	if err != nil {
 		return err
-	} else if size := len(data); n != size {
+	} else if size := len(record); n != size {
 		return Errorf("Expected to write %d bytes; only wrote %d bytes\n", size, n)
 	}
-	end := int64(len(data))
-	if numBlocks := len(c.ends); numBlocks > 0 {
-		end += c.ends[numBlocks-1]
+	if err = c.file.Sync(); err != nil {
+		return err
 	}
-	c.ends = append(c.ends, end)
+	c.index(b, data, begin+int64(len(record)))
 	return nil
 }
 
+// Merkle root of all blocks written so far
+func (c *Chain) Root() []byte {
+	return c.blocks.Root()
+}
+
+// Merkle root of the first size blocks
+func (c *Chain) RootAt(size int) ([]byte, error) {
+	return c.blocks.RootAt(int64(size))
+}
+
+// Proves block id is in the chain of the first size blocks
+func (c *Chain) ProveBlock(id, size int) (*merkle.InclusionProof, error) {
+	return c.blocks.ProveInclusion(int64(id), int64(size))
+}
+
+// Proves the chain of the first oldSize blocks
+// is a prefix of the chain of the first newSize blocks
+func (c *Chain) ProveConsistency(oldSize, newSize int) (*merkle.ConsistencyProof, error) {
+	return c.blocks.ProveConsistency(int64(oldSize), int64(newSize))
+}
+
 func (c *Chain) MustWrite(b *Block) {
 	err := c.Write(b)
 	Check(err)
 }
 
 func (c *Chain) Read(id int) (*Block, error) {
-	// id should not overflow int
-	if id < 0 {
-		return nil, Error("Block id cannot be less than zero")
+	if id < 0 || id >= len(c.ends) {
+		return nil, ErrBlockNotFound
 	}
-	var begin, end int64
+	var begin int64
 	if id > 0 {
 		begin = c.ends[id-1]
 	}
-	if id < len(c.ends) {
-		end = c.ends[id]
-	} else {
-		// just set end to file_size
-		stat, err := c.file.Stat()
-		if err != nil {
-			return nil, err
-		}
-		end = stat.Size()
-	}
-	data := make([]byte, end-begin)
-	n, err := c.file.ReadAt(data, begin)
+	data, _, err := c.readRecord(begin, c.ends[id])
 	if err != nil {
 		return nil, err
-	} else if size := len(data); n != size {
-		return nil, Errorf("Expected to write %d bytes; only wrote %d bytes\n", size, n)
 	}
 	b := new(Block)
 	UnmarshalJSON(data, b)
@@ -78,3 +240,11 @@ func (c *Chain) MustRead(id int) *Block {
 	Check(err)
 	return b
 }
+
+func (c *Chain) ReadByHash(hash []byte) (*Block, error) {
+	id, ok := c.hashes[string(hash)]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return c.Read(id)
+}
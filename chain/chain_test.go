@@ -0,0 +1,650 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/crypto/tndr"
+	"github.com/zbo14/pos/graph"
+	proto "github.com/zbo14/pos/protocol"
+	. "github.com/zbo14/pos/util"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	CHAIN_PATH = "test_chain"
+	PASSWORD   = "it's a secret"
+)
+
+var priv = tndr.GeneratePrivKey(PASSWORD)
+
+func writeBlocks(t *testing.T, c *Chain, n int) []*Block {
+	var blocks []*Block
+	var b *Block
+	if last := c.Last(); last >= 0 {
+		b = c.MustRead(last)
+	}
+	for i := 0; i < n; i++ {
+		if b == nil {
+			b = GenesisBlock(nil, priv, nil, nil)
+		} else {
+			b = NewBlock(nil, b, priv, nil, nil)
+		}
+		if err := c.Write(b); err != nil {
+			t.Fatal(err.Error())
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func checkBlocks(t *testing.T, c *Chain, blocks []*Block) {
+	if height := c.Height(); height != len(blocks) {
+		t.Fatalf("Expected height=%d; got height=%d", len(blocks), height)
+	}
+	for id, expected := range blocks {
+		b, err := c.Read(id)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(b, expected) {
+			t.Fatalf("Expected block %d=%v; got %v", id, expected, b)
+		}
+		if b, err = c.ReadByHash(expected.Hash()); err != nil || b.BlockId != int64(id) {
+			t.Fatalf("Could not read block %d by hash", id)
+		}
+	}
+	if _, err := c.Read(len(blocks)); err != ErrBlockNotFound {
+		t.Fatalf("Expected err=%v; got err=%v", ErrBlockNotFound, err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	defer os.Remove(CHAIN_PATH)
+	c := NewChain(CHAIN_PATH)
+	blocks := writeBlocks(t, c, 5)
+	checkBlocks(t, c, blocks)
+	root := c.Root()
+	c.Close()
+	// Reopen
+	c, err := OpenChain(CHAIN_PATH)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checkBlocks(t, c, blocks)
+	if !bytes.Equal(c.Root(), root) {
+		t.Fatal("Reopened chain has a different root")
+	}
+	if c.Truncated() != 0 {
+		t.Fatalf("Expected no bytes truncated; got %d", c.Truncated())
+	}
+	blocks = append(blocks, writeBlocks(t, c, 2)...)
+	c.Close()
+	stat, _ := os.Stat(CHAIN_PATH)
+	size := stat.Size()
+	// Torn writes
+	record := make([]byte, 58)
+	binary.BigEndian.PutUint64(record, 100)
+	b := NewBlock(nil, blocks[6], priv, nil, nil)
+	data := b.Serialize()
+	flipped := make([]byte, 8, len(data)+RECORD_OVERHEAD)
+	binary.BigEndian.PutUint64(flipped, uint64(len(data)))
+	flipped = append(append(flipped, data...), checksum(data)...)
+	flipped[len(flipped)-1] ^= 1
+	for _, torn := range [][]byte{record[:4], record, flipped} {
+		file, _ := os.OpenFile(CHAIN_PATH, os.O_APPEND|os.O_WRONLY, 0644)
+		file.Write(torn)
+		file.Close()
+		if c, err = OpenChain(CHAIN_PATH); err != nil {
+			t.Fatal(err.Error())
+		}
+		if c.Truncated() != int64(len(torn)) {
+			t.Fatalf("Expected %d bytes truncated; got %d", len(torn), c.Truncated())
+		}
+		checkBlocks(t, c, blocks)
+		c.Close()
+	}
+	if stat, _ = os.Stat(CHAIN_PATH); stat.Size() != size {
+		t.Fatalf("Expected size=%d; got size=%d", size, stat.Size())
+	}
+	// Corrupted record before the last
+	file, _ := os.OpenFile(CHAIN_PATH, os.O_RDWR, 0644)
+	file.WriteAt([]byte{'!'}, 10)
+	file.Close()
+	if _, err = OpenChain(CHAIN_PATH); err != ErrChainCorrupted {
+		t.Fatalf("Expected err=%v; got err=%v", ErrChainCorrupted, err)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	defer os.Remove(CHAIN_PATH)
+	c := NewChain(CHAIN_PATH)
+	defer c.Close()
+	blocks := writeBlocks(t, c, 3)
+	for i, b := range blocks {
+		var prev *Block
+		if i > 0 {
+			prev = blocks[i-1]
+		}
+		if err := CheckLink(prev, b); err != nil {
+			t.Fatal(err.Error())
+		}
+		if hash := b.Hash(); len(hash) != HASH_SIZE {
+			t.Fatalf("Expected hash size=%d; got size=%d", HASH_SIZE, len(hash))
+		}
+	}
+	// Header commits to the contents
+	b := NewBlock(nil, blocks[2], priv, nil, nil)
+	b.SubTx.Txs = append(b.SubTx.Txs, NewTx(NewTxCommit(ZeroHash(), tndr.PubKey(priv))))
+	if err := b.CheckHeader(); err != ErrBlockHeader {
+		t.Fatalf("Expected err=%v; got err=%v", ErrBlockHeader, err)
+	}
+	b = NewBlock(nil, blocks[2], priv, nil, nil)
+	hash := b.Hash()
+	b.Header.Timestamp++
+	if err := CheckLink(blocks[2], b); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(b.Hash(), hash) {
+		t.Fatal("Expected timestamp to change block hash")
+	}
+	// Timestamps do not go back or run ahead of the clock
+	for _, timestamp := range []int64{
+		blocks[2].Header.Timestamp - 1,
+		time.Now().Add(MAX_CLOCK_DRIFT + time.Minute).Unix(),
+	} {
+		b.Header.Timestamp = timestamp
+		if err := CheckLink(blocks[2], b); err != ErrTimestamp {
+			t.Fatalf("Expected err=%v; got err=%v", ErrTimestamp, err)
+		}
+	}
+	// Tx root commits to the canonical tx encoding
+	b = NewBlock(nil, blocks[2], priv, nil, []*Tx{NewTx(NewTxCommit(ZeroHash(), tndr.PubKey(priv)))})
+	b.SubTx.Txs[0].TxCommit.PubKey[0] ^= 1
+	if err := b.CheckHeader(); err != ErrBlockHeader {
+		t.Fatalf("Expected err=%v; got err=%v", ErrBlockHeader, err)
+	}
+	// Blocks must link to the last block
+	for _, b = range []*Block{
+		GenesisBlock(nil, priv, nil, nil),
+		NewBlock(nil, blocks[1], priv, nil, nil),
+	} {
+		if err := c.Write(b); err != ErrPrevHash {
+			t.Fatalf("Expected err=%v; got err=%v", ErrPrevHash, err)
+		}
+	}
+	if height := c.Height(); height != 3 {
+		t.Fatalf("Expected height=3; got height=%d", height)
+	}
+}
+
+// Recomputes the header after the block contents change
+func reheader(b *Block, prevHash []byte) {
+	b.Header = NewHeader(b.BlockId, prevHash, b.SubHash, b.SubSignature, b.SubTx, b.Header.Timestamp)
+}
+
+// Sector with a commit registered on the verifier
+func newTestSector(t *testing.T) (*proto.Sector, *proto.Verifier) {
+	spec := graph.DefaultSpec(graph.DOUBLE_BUTTERFLY)
+	params := proto.NewParams(spec, proto.DEFAULT_SOUNDNESS, proto.DEFAULT_FRACTION)
+	return newParamsSector(t, params)
+}
+
+func newParamsSector(t *testing.T, params *proto.Params) (*proto.Sector, *proto.Verifier) {
+	p := proto.NewProver(priv, params)
+	sec := p.MustAddSector(0)
+	v := proto.NewVerifier(params)
+	if err := v.Register(sec.Commit, p.PubKey()); err != nil {
+		t.Fatal(err.Error())
+	}
+	return sec, v
+}
+
+func cleanup() {
+	os.RemoveAll("Graph")
+	os.RemoveAll("tree")
+}
+
+// Block after prev with proofs from the seed derived from prev
+func mineBlock(sec *proto.Sector, prev *Block, txs []*Tx) *Block {
+	seed := NextSeed(prev, sec.Params().SeedSize)
+	commitProof, spaceProof := sec.ProveCommitNI(seed), sec.ProveSpaceNI(seed)
+	if prev == nil {
+		return GenesisBlock(commitProof, priv, spaceProof, txs)
+	}
+	return NewBlock(commitProof, prev, priv, spaceProof, txs)
+}
+
+func TestValidateBlock(t *testing.T) {
+	defer cleanup()
+	sec, v := newTestSector(t)
+	defer sec.Close()
+	params := v.Params()
+	genesis := mineBlock(sec, nil, nil)
+	if err := ValidateBlock(nil, genesis, v); err != nil {
+		t.Fatal(err.Error())
+	}
+	b := mineBlock(sec, genesis, nil)
+	if err := ValidateBlock(genesis, b, v); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ValidateBlock(nil, b, v); err != ErrPrevHash {
+		t.Fatalf("Expected err=%v; got err=%v", ErrPrevHash, err)
+	}
+	commitProof, spaceProof := b.SubHash.CommitProof, b.SubHash.SpaceProof
+	// Block id
+	b = NewBlock(commitProof, genesis, priv, spaceProof, nil)
+	b.BlockId, b.SubHash.BlockId, b.SubSignature.BlockId, b.SubTx.BlockId = 2, 2, 2, 2
+	reheader(b, genesis.Hash())
+	if err := ValidateBlock(genesis, b, v); err != ErrBlockId {
+		t.Fatalf("Expected err=%v; got err=%v", ErrBlockId, err)
+	}
+	// Proofs
+	b = NewBlock(nil, genesis, priv, spaceProof, nil)
+	if err := ValidateBlock(genesis, b, v); err != ErrMissingProof {
+		t.Fatalf("Expected err=%v; got err=%v", ErrMissingProof, err)
+	}
+	other := tndr.GeneratePrivKey(PASSWORD)
+	otherProof := *spaceProof
+	otherProof.PubKey = tndr.PubKey(other)
+	b = NewBlock(commitProof, genesis, priv, &otherProof, nil)
+	if err := ValidateBlock(genesis, b, v); err != ErrProofPubKey {
+		t.Fatalf("Expected err=%v; got err=%v", ErrProofPubKey, err)
+	}
+	otherProof = *spaceProof
+	otherProof.Commit = ZeroHash()
+	b = NewBlock(commitProof, genesis, priv, &otherProof, nil)
+	if err := ValidateBlock(genesis, b, v); err != ErrCommitMismatch {
+		t.Fatalf("Expected err=%v; got err=%v", ErrCommitMismatch, err)
+	}
+	// Seeds must be derived from the previous block
+	seed := make([]byte, proto.DEFAULT_SEED_SIZE)
+	for _, proofs := range []struct {
+		commitProof *proto.CommitProof
+		spaceProof  *proto.SpaceProof
+	}{
+		{sec.ProveCommitNI(seed), spaceProof},
+		{commitProof, sec.ProveSpaceNI(seed)},
+		{genesis.SubHash.CommitProof, genesis.SubHash.SpaceProof},
+	} {
+		b = NewBlock(proofs.commitProof, genesis, priv, proofs.spaceProof, nil)
+		if err := ValidateBlock(genesis, b, v); err != ErrSeed {
+			t.Fatalf("Expected err=%v; got err=%v", ErrSeed, err)
+		}
+	}
+	// Signatures
+	b = NewBlock(commitProof, genesis, other, spaceProof, nil)
+	if err := ValidateBlock(genesis, b, v); err != ErrSubHashSig {
+		t.Fatalf("Expected err=%v; got err=%v", ErrSubHashSig, err)
+	}
+	b = NewBlock(commitProof, genesis, priv, spaceProof, nil)
+	b.SubSignature.SignatureSig = b.SubSignature.SignatureTx
+	reheader(b, genesis.Hash())
+	if err := ValidateBlock(genesis, b, v); err != ErrSubSigSig {
+		t.Fatalf("Expected err=%v; got err=%v", ErrSubSigSig, err)
+	}
+	b = NewBlock(commitProof, genesis, priv, spaceProof, nil)
+	b.SubSignature.SignatureTx = b.SubSignature.SignatureSig
+	reheader(b, genesis.Hash())
+	if err := ValidateBlock(genesis, b, v); err != ErrTxSig {
+		t.Fatalf("Expected err=%v; got err=%v", ErrTxSig, err)
+	}
+	// Unregistered commit
+	b = NewBlock(commitProof, genesis, priv, spaceProof, nil)
+	err := ValidateBlock(genesis, b, proto.NewVerifier(params))
+	if invalid, ok := err.(*ErrInvalidProof); !ok || invalid.Err != proto.ErrUnknownCommit {
+		t.Fatalf("Expected invalid commit proof; got err=%v", err)
+	}
+	// Invalid space proof
+	otherProof = *spaceProof
+	otherProof.Proofs = otherProof.Proofs[1:]
+	b = NewBlock(commitProof, genesis, priv, &otherProof, nil)
+	if err, ok := ValidateBlock(genesis, b, v).(*ErrInvalidProof); !ok || err.Proof != "space" {
+		t.Fatalf("Expected invalid space proof; got err=%v", err)
+	}
+	// Duplicate txs
+	tx := NewTx(NewTxCommit(sec.Commit, tndr.PubKey(priv)))
+	b = NewBlock(commitProof, genesis, priv, spaceProof, []*Tx{tx, tx})
+	if err = ValidateBlock(genesis, b, v); err != ErrDuplicateTx {
+		t.Fatalf("Expected err=%v; got err=%v", ErrDuplicateTx, err)
+	}
+}
+
+func TestSeedSize(t *testing.T) {
+	defer cleanup()
+	spec := graph.DefaultSpec(graph.DOUBLE_BUTTERFLY)
+	params := proto.NewParams(spec, proto.DEFAULT_SOUNDNESS, proto.DEFAULT_FRACTION)
+	params.SeedSize = 32
+	sec, v := newParamsSector(t, params)
+	defer sec.Close()
+	genesis := mineBlock(sec, nil, nil)
+	if size := len(genesis.SubHash.SpaceProof.Seed); size != params.SeedSize {
+		t.Fatalf("Expected seed size=%d; got size=%d", params.SeedSize, size)
+	}
+	if err := ValidateBlock(nil, genesis, v); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ValidateBlock(genesis, mineBlock(sec, genesis, nil), v); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestBlockTree(t *testing.T) {
+	defer cleanup()
+	sec, v := newTestSector(t)
+	defer sec.Close()
+	genesis := mineBlock(sec, nil, nil)
+	if _, err := NewBlockTree(genesis, nil); err != ErrNoVerifier {
+		t.Fatalf("Expected err=%v; got err=%v", ErrNoVerifier, err)
+	}
+	tree, err := NewBlockTree(genesis, v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Blocks are validated before they are weighed
+	unverified := mineBlock(sec, genesis, nil)
+	unverified.SubHash.SpaceProof.Proofs[0].Value[0] ^= 1
+	reheader(unverified, genesis.Hash())
+	if _, ok := tree.Add(unverified).(*ErrInvalidProof); !ok || tree.Len() != 1 {
+		t.Fatal("Expected block with invalid space proof to be rejected")
+	}
+	var applied, reverted []*Block
+	tree.MustOnReorg(func(b *Block) error {
+		applied = append(applied, b)
+		return nil
+	}, func(b *Block) error {
+		reverted = append(reverted, b)
+		return nil
+	})
+	if len(applied) != 1 || applied[0] != genesis {
+		t.Fatal("Expected genesis block to be applied")
+	}
+	applied = nil
+	a := mineBlock(sec, genesis, nil)
+	tree.MustAdd(a)
+	if tree.Head() != a || len(applied) != 1 || applied[0] != a {
+		t.Fatal("Expected head to extend to block")
+	}
+	if err = tree.Add(a); err != ErrBlockExists {
+		t.Fatalf("Expected err=%v; got err=%v", ErrBlockExists, err)
+	}
+	if err = tree.Add(mineBlock(sec, mineBlock(sec, a, nil), nil)); err != ErrOrphanBlock {
+		t.Fatalf("Expected err=%v; got err=%v", ErrOrphanBlock, err)
+	}
+	// A branch with the same quality does not move the head,
+	// its block has the same proofs since it has the same seed
+	applied = nil
+	tx := NewTx(NewTxCommit(sec.Commit, tndr.PubKey(priv)))
+	branch := []*Block{mineBlock(sec, genesis, []*Tx{tx})}
+	tree.MustAdd(branch[0])
+	if tree.Head() != a || len(applied) != 0 {
+		t.Fatal("Expected head to stay on the first branch")
+	}
+	// Until its cumulative quality is higher
+	for tree.Head() == a {
+		if len(branch) > 100 {
+			t.Fatal("Expected branch to overtake the head")
+		}
+		b := mineBlock(sec, branch[len(branch)-1], nil)
+		tree.MustAdd(b)
+		branch = append(branch, b)
+	}
+	if len(reverted) != 1 || reverted[0] != a {
+		t.Fatalf("Expected block to be reverted; got %v", reverted)
+	}
+	if !reflect.DeepEqual(applied, branch) {
+		t.Fatal("Expected branch to be applied in order")
+	}
+	if !reflect.DeepEqual(tree.MainChain(), append([]*Block{genesis}, branch...)) {
+		t.Fatal("Main chain does not match branch")
+	}
+	if tree.Len() != len(branch)+2 {
+		t.Fatalf("Expected %d blocks; got %d", len(branch)+2, tree.Len())
+	}
+	quality, err := tree.QualityOf(a.Hash())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := BlockWeight(genesis) + BlockWeight(a); quality != expected {
+		t.Fatalf("Expected quality=%f; got quality=%f", expected, quality)
+	}
+	if quality >= tree.Quality() {
+		t.Fatal("Expected head to have the highest quality")
+	}
+}
+
+func TestBlockTreeRollback(t *testing.T) {
+	defer cleanup()
+	sec, v := newTestSector(t)
+	defer sec.Close()
+	genesis := mineBlock(sec, nil, nil)
+	tree := MustNewBlockTree(genesis, v)
+	errApply, errRevert := Error("apply failed"), Error("revert failed")
+	noop := func(*Block) error { return nil }
+	tree.MustOnReorg(noop, func(*Block) error { return errRevert })
+	tree.MustOnReorg(func(b *Block) error {
+		if b != genesis {
+			return errApply
+		}
+		return nil
+	}, noop)
+	// The second callback fails to apply the block,
+	// then the first fails to revert it
+	b := mineBlock(sec, genesis, nil)
+	err, ok := tree.Add(b).(*ErrRollback)
+	if !ok || err.Err != errApply || err.Rollback != errRevert {
+		t.Fatalf("Expected rollback error; got err=%v", err)
+	}
+	if tree.Head() != genesis || tree.Len() != 1 {
+		t.Fatal("Expected head to stay and block to be removed")
+	}
+}
+
+func TestBlockTreeLedger(t *testing.T) {
+	defer cleanup()
+	sec, v := newTestSector(t)
+	defer sec.Close()
+	alice := priv
+	alicePub := tndr.PubKey(alice)
+	bobPub := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD))
+	carolPub := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD))
+	alloc := NewTx(NewTxPayment(nil, []*Out{NewOut(alicePub, 100)}))
+	genesis := mineBlock(sec, nil, []*Tx{alloc})
+	tree := MustNewBlockTree(genesis, v)
+	l := NewLedger()
+	tree.MustOnReorg(l.Apply, l.Revert)
+	if l.Height() != 1 || l.Balance(alicePub) != 100 {
+		t.Fatal("Expected genesis outputs in the ledger")
+	}
+	// Callbacks that fail on the main chain are not added
+	applied := NewLedger()
+	applied.MustApply(genesis)
+	if err := tree.OnReorg(applied.Apply, applied.Revert); err != ErrDuplicateTx {
+		t.Fatalf("Expected err=%v; got err=%v", ErrDuplicateTx, err)
+	}
+	// Alice pays bob, then carol on a competing branch
+	spend := func(pub crypto.PubKeyEd25519, value int64) *Tx {
+		outs := []*Out{NewOut(pub, value)}
+		return NewTx(NewTxPayment([]*In{NewIn(0, outs, alice, alicePub, alloc.Id())}, outs))
+	}
+	a := mineBlock(sec, genesis, []*Tx{spend(bobPub, 60)})
+	tree.MustAdd(a)
+	b1 := mineBlock(sec, genesis, []*Tx{spend(carolPub, 30)})
+	tree.MustAdd(b1)
+	if tree.Head() != a || l.Balance(bobPub) != 60 || l.Balance(carolPub) != 0 {
+		t.Fatal("Expected ledger to follow the first branch")
+	}
+	b2 := mineBlock(sec, b1, nil)
+	tree.MustAdd(b2)
+	if tree.Head() != b2 || l.Height() != 3 || l.Balance(bobPub) != 0 || l.Balance(carolPub) != 30 {
+		t.Fatal("Expected ledger to follow the reorganization")
+	}
+	// A branch with a block the ledger rejects
+	c1 := mineBlock(sec, a, []*Tx{spend(carolPub, 40)})
+	tree.MustAdd(c1)
+	c2 := mineBlock(sec, c1, nil)
+	if err := tree.Add(c2); err != ErrDoubleSpend {
+		t.Fatalf("Expected err=%v; got err=%v", ErrDoubleSpend, err)
+	}
+	if tree.Head() != b2 || l.Height() != 3 || l.Balance(bobPub) != 0 || l.Balance(carolPub) != 30 {
+		t.Fatal("Expected ledger to be restored to the old branch")
+	}
+	if _, err := tree.Get(c1.Hash()); err != ErrBlockNotFound || tree.Len() != 4 {
+		t.Fatal("Expected invalid block and descendants to be removed")
+	}
+	for _, b := range []*Block{c1, mineBlock(sec, c2, nil)} {
+		if err := tree.Add(b); err != ErrInvalidBlock {
+			t.Fatalf("Expected err=%v; got err=%v", ErrInvalidBlock, err)
+		}
+	}
+	// The valid block on that branch can still be extended
+	tree.MustAdd(mineBlock(sec, a, nil))
+	tree.MustAdd(mineBlock(sec, b2, nil))
+	if int64(l.Height()) != tree.Head().BlockId+1 {
+		t.Fatal("Expected ledger height to match the head")
+	}
+}
+
+func TestLedger(t *testing.T) {
+	alice, bob := priv, tndr.GeneratePrivKey(PASSWORD)
+	alicePub, bobPub := tndr.PubKey(alice), tndr.PubKey(bob)
+	l := NewLedger()
+	alloc := NewTx(NewTxPayment(nil, []*Out{NewOut(alicePub, 100), NewOut(bobPub, 50)}))
+	genesis := GenesisBlock(nil, priv, nil, []*Tx{alloc})
+	l.MustApply(genesis)
+	if l.Balance(alicePub) != 100 || l.Balance(bobPub) != 50 || !l.HasTx(alloc.Id()) {
+		t.Fatal("Expected genesis outputs to be allocated")
+	}
+	// Alice pays bob 60 and keeps 40
+	outs := []*Out{NewOut(bobPub, 60), NewOut(alicePub, 40)}
+	pay := NewTx(NewTxPayment([]*In{NewIn(0, outs, alice, alicePub, alloc.Id())}, outs))
+	b := NewBlock(nil, genesis, priv, nil, []*Tx{pay})
+	l.MustApply(b)
+	if l.Balance(alicePub) != 40 || l.Balance(bobPub) != 110 {
+		t.Fatalf("Expected balances 40, 110; got %d, %d", l.Balance(alicePub), l.Balance(bobPub))
+	}
+	if l.Output(alloc.Id(), 0) != nil || l.Output(pay.Id(), 1) == nil || l.NumOutputs() != 3 {
+		t.Fatal("Expected spent output to be removed and outs to be added")
+	}
+	// Invalid payments
+	outs = []*Out{NewOut(bobPub, 10)}
+	for _, test := range []struct {
+		tx  *Tx
+		err error
+	}{
+		{pay, ErrDuplicateTx},
+		{NewTx(NewTxPayment([]*In{NewIn(0, outs, alice, alicePub, alloc.Id())}, outs)), ErrDoubleSpend},
+		{NewTx(NewTxPayment([]*In{NewIn(1, outs, alice, alicePub, pay.Id()), NewIn(1, outs, alice, alicePub, pay.Id())}, outs)), ErrDoubleSpend},
+		{NewTx(NewTxPayment([]*In{NewIn(5, outs, alice, alicePub, pay.Id())}, outs)), ErrUnknownOutput},
+		{NewTx(NewTxPayment([]*In{NewIn(0, outs, alice, alicePub, pay.Id())}, outs)), ErrInPubKey},
+		{NewTx(NewTxPayment([]*In{NewIn(1, outs, bob, alicePub, pay.Id())}, outs)), ErrInSignature},
+		{NewTx(NewTxPayment([]*In{NewIn(1, outs[:0], alice, alicePub, pay.Id())}, outs)), ErrInSignature},
+		{NewTx(NewTxPayment(nil, outs)), ErrNoIns},
+		{NewTx(NewTxPayment([]*In{NewIn(1, outs[:0], alice, alicePub, pay.Id())}, []*Out{NewOut(bobPub, 0)})), ErrOutValue},
+		{NewTx(NewTxPayment([]*In{NewIn(1, []*Out{NewOut(bobPub, 41)}, alice, alicePub, pay.Id())}, []*Out{NewOut(bobPub, 41)})), ErrOverspend},
+	} {
+		next := NewBlock(nil, b, priv, nil, []*Tx{test.tx})
+		if err := l.Apply(next); err != test.err {
+			t.Fatalf("Expected err=%v; got err=%v", test.err, err)
+		}
+	}
+	// A block with an invalid payment is not applied
+	valid := NewTx(NewTxPayment([]*In{NewIn(1, outs, alice, alicePub, pay.Id())}, outs))
+	refund := []*Out{NewOut(alicePub, 20)}
+	invalid := NewTx(NewTxPayment([]*In{NewIn(1, refund, alice, alicePub, pay.Id())}, refund))
+	for _, txs := range [][]*Tx{{valid, invalid}, {valid, valid}} {
+		if err := l.Apply(NewBlock(nil, b, priv, nil, txs)); err == nil {
+			t.Fatal("Expected block with invalid payment to fail")
+		}
+	}
+	if l.Height() != 2 || l.HasTx(valid.Id()) || l.Balance(alicePub) != 40 || l.Balance(bobPub) != 110 {
+		t.Fatal("Expected block not to be applied")
+	}
+	// Spending an output created in the same block
+	refund = []*Out{NewOut(alicePub, 10)}
+	spend := NewTx(NewTxPayment([]*In{NewIn(0, refund, bob, bobPub, valid.Id())}, refund))
+	next := NewBlock(nil, b, priv, nil, []*Tx{valid, spend})
+	l.MustApply(next)
+	if l.Balance(alicePub) != 10 || l.Balance(bobPub) != 110 {
+		t.Fatalf("Expected balances 10, 110; got %d, %d", l.Balance(alicePub), l.Balance(bobPub))
+	}
+	// Rollback
+	if err := l.Revert(b); err != ErrRevertOrder {
+		t.Fatalf("Expected err=%v; got err=%v", ErrRevertOrder, err)
+	}
+	l.MustRevert(next)
+	l.MustRevert(b)
+	if l.Height() != 1 || l.NumOutputs() != 2 || l.HasTx(pay.Id()) || l.Balance(alicePub) != 100 || l.Balance(bobPub) != 50 {
+		t.Fatal("Expected ledger to roll back to the genesis block")
+	}
+	l.MustApply(b)
+	if l.Balance(alicePub) != 40 || l.Balance(bobPub) != 110 {
+		t.Fatal("Expected block to apply again after rollback")
+	}
+}
+
+func TestMempool(t *testing.T) {
+	pool := NewMempool()
+	pub := tndr.PubKey(priv)
+	commit := NewTx(NewTxCommit(ZeroHash(), pub))
+	pay := NewTx(NewTxPayment(nil, []*Out{NewOut(pub, 1)}))
+	pool.MustAdd(commit)
+	pool.MustAdd(pay)
+	// Txs with the same contents have the same id
+	if err := pool.Add(NewTx(NewTxCommit(ZeroHash(), pub))); err != ErrDuplicateTx {
+		t.Fatalf("Expected err=%v; got err=%v", ErrDuplicateTx, err)
+	}
+	data, _ := commit.MarshalBinary()
+	if !bytes.Equal(commit.Id(), Sum32(data)) || bytes.Equal(commit.Id(), pay.Id()) {
+		t.Fatal("Expected tx id to be the hash of the tx")
+	}
+	if pool.Len() != 2 || !pool.Has(pay.Id()) {
+		t.Fatalf("Expected 2 txs; got %d", pool.Len())
+	}
+	// Included txs are removed
+	pool.Remove(GenesisBlock(nil, priv, nil, []*Tx{commit}))
+	if pool.Len() != 1 || pool.Has(commit.Id()) || pool.Txs()[0] != pay {
+		t.Fatal("Expected included tx to be removed")
+	}
+	pool.MustAdd(commit)
+	if err := pool.Add(new(Tx)); err != ErrTxEncoding {
+		t.Fatalf("Expected err=%v; got err=%v", ErrTxEncoding, err)
+	}
+}
+
+func TestTxId(t *testing.T) {
+	pub := tndr.PubKey(priv)
+	other := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD + "!"))
+	// Txs that differ only in public keys have different ids
+	proof := NewPunishmentProof(pub, nil, nil, nil, nil)
+	pairs := [][2]*Tx{
+		{NewTx(NewTxCommit(ZeroHash(), pub)), NewTx(NewTxCommit(ZeroHash(), other))},
+		{NewTx(NewTxPunishment(pub, NewPunishment(1, pub, proof))), NewTx(NewTxPunishment(other, NewPunishment(1, pub, proof)))},
+		{NewTx(NewTxPayment(nil, []*Out{NewOut(pub, 1)})), NewTx(NewTxPayment(nil, []*Out{NewOut(other, 1)}))},
+	}
+	for _, pair := range pairs {
+		if id := pair[0].Id(); id == nil || bytes.Equal(id, pair[1].Id()) {
+			t.Fatalf("Expected different tx ids; got %x", id)
+		}
+		// Public keys survive a JSON round trip
+		tx := new(Tx)
+		UnmarshalJSON(pair[1].Serialize(), tx)
+		if !bytes.Equal(tx.Id(), pair[1].Id()) {
+			t.Fatal("Expected tx id to be unchanged after JSON round trip")
+		}
+	}
+	// Txs without exactly one type have no id
+	both := NewTx(NewTxCommit(ZeroHash(), pub))
+	both.TxPayment = NewTxPayment(nil, nil)
+	for _, tx := range []*Tx{new(Tx), both, NewTx(NewTxPunishment(pub, nil))} {
+		if _, err := tx.MarshalBinary(); err != ErrTxEncoding {
+			t.Errorf("Expected err=%v; got err=%v", ErrTxEncoding, err)
+		}
+		if tx.Id() != nil {
+			t.Error("Expected nil id for invalid tx")
+		}
+	}
+}
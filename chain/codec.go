@@ -0,0 +1,125 @@
+package chain
+
+import (
+	"encoding/binary"
+	. "github.com/zbo14/pos/util"
+)
+
+// Canonical binary encoding of txs
+// Tx ids hash this encoding, so every field is included.
+// Integers are big endian, byte strings and lists are
+// prefixed with their length (4 bytes).
+//
+// tx: type (1 byte), then exactly one of
+// commit: commit, public key
+// payment: num ins, ins, num outs, outs
+//   in: index (8 bytes), public key, signature, tx hash
+//   out: public key, value (8 bytes)
+// punishment: public key, block id (8 bytes), public key,
+//   proof public key, header hashes of the proof blocks
+//   (empty for a missing block)
+// Punishments need a proof, ins and outs cannot be nil.
+//
+// Headers commit to the block contents, so a punishment
+// proof is identified by the hashes of its blocks.
+
+const (
+	TX_COMMIT     byte = 0x01
+	TX_PAYMENT    byte = 0x02
+	TX_PUNISHMENT byte = 0x03
+)
+
+var ErrTxEncoding = Error("Tx has no canonical encoding")
+
+type txEncoder struct {
+	data []byte
+}
+
+func (enc *txEncoder) write(bz []byte) {
+	enc.data = append(enc.data, bz...)
+}
+
+func (enc *txEncoder) writeUint32(i int) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(i))
+	enc.write(buf[:])
+}
+
+func (enc *txEncoder) writeInt64(i int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	enc.write(buf[:])
+}
+
+func (enc *txEncoder) writeBytes(bz []byte) {
+	enc.writeUint32(len(bz))
+	enc.write(bz)
+}
+
+func (tx *Tx) MarshalBinary() ([]byte, error) {
+	if tx == nil {
+		return nil, ErrTxEncoding
+	}
+	enc := new(txEncoder)
+	switch {
+	case tx.TxCommit != nil && tx.TxPayment == nil && tx.TxPunishment == nil:
+		enc.write([]byte{TX_COMMIT})
+		enc.writeBytes(tx.TxCommit.Commit)
+		enc.write(tx.TxCommit.PubKey[:])
+	case tx.TxCommit == nil && tx.TxPayment != nil && tx.TxPunishment == nil:
+		enc.write([]byte{TX_PAYMENT})
+		if err := enc.writePayment(tx.TxPayment); err != nil {
+			return nil, err
+		}
+	case tx.TxCommit == nil && tx.TxPayment == nil && tx.TxPunishment != nil:
+		enc.write([]byte{TX_PUNISHMENT})
+		if err := enc.writePunishment(tx.TxPunishment); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrTxEncoding
+	}
+	return enc.data, nil
+}
+
+func (enc *txEncoder) writePayment(payment *TxPayment) error {
+	enc.writeUint32(len(payment.Ins))
+	for _, in := range payment.Ins {
+		if in == nil {
+			return ErrTxEncoding
+		}
+		enc.writeInt64(int64(in.Index))
+		enc.write(in.PubKey[:])
+		enc.write(in.Signature[:])
+		enc.writeBytes(in.TxHash)
+	}
+	enc.writeUint32(len(payment.Outs))
+	for _, out := range payment.Outs {
+		if out == nil {
+			return ErrTxEncoding
+		}
+		enc.write(out.PubKey[:])
+		enc.writeInt64(out.Value)
+	}
+	return nil
+}
+
+func (enc *txEncoder) writePunishment(txPunishment *TxPunishment) error {
+	punishment := txPunishment.Punishment
+	if punishment == nil || punishment.PunishmentProof == nil {
+		return ErrTxEncoding
+	}
+	proof := punishment.PunishmentProof
+	enc.write(txPunishment.PubKey[:])
+	enc.writeInt64(punishment.BlockId)
+	enc.write(punishment.PubKey[:])
+	enc.write(proof.PubKey[:])
+	for _, b := range []*Block{proof.Chain1Next, proof.Chain1Recent, proof.Chain2Next, proof.Chain2Recent} {
+		var hash []byte
+		if b != nil {
+			hash = b.Hash()
+		}
+		enc.writeBytes(hash)
+	}
+	return nil
+}
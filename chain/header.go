@@ -0,0 +1,124 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/zbo14/pos/util"
+	"time"
+)
+
+// Block header
+// The header commits to the contents of a block and the hash
+// of the previous block, so blocks form a hash-linked chain.
+// Canonical encoding, integers are big endian:
+// block id (8 bytes) | prev hash | sub hash digest |
+// sub signature digest | tx root | timestamp (8 bytes)
+// The genesis block has a zero prev hash. A block's
+// timestamp is not earlier than the previous block's and
+// at most MAX_CLOCK_DRIFT ahead of the local clock.
+
+const (
+	HEADER_SIZE     = 8 + 4*HASH_SIZE + 8
+	MAX_CLOCK_DRIFT = 2 * time.Hour
+)
+
+var (
+	ErrBlockHeader = Error("Block header does not match block contents")
+	ErrPrevHash    = Error("Block does not link to the previous block hash")
+	ErrTimestamp   = Error("Block timestamp is before the previous block or too far in the future")
+)
+
+type Header struct {
+	BlockId     int64  `json:"block_id"`
+	PrevHash    []byte `json:"prev_hash"`
+	SubHashHash []byte `json:"hash_sub_hash"`
+	SubSigHash  []byte `json:"signature_sub_hash"`
+	Timestamp   int64  `json:"timestamp"` // unix seconds
+	TxRoot      []byte `json:"tx_root"`
+}
+
+func NewHeader(blockId int64, prevHash []byte, subHash *SubHash, subSig *SubSignature, subTx *SubTx, timestamp int64) *Header {
+	return &Header{
+		BlockId:     blockId,
+		PrevHash:    prevHash,
+		SubHashHash: Sum32(subHash.Serialize()),
+		SubSigHash:  Sum32(subSig.Serialize()),
+		Timestamp:   timestamp,
+		TxRoot:      subTx.TxRoot(),
+	}
+}
+
+func (header *Header) MarshalBinary() ([]byte, error) {
+	for _, hash := range [][]byte{header.PrevHash, header.SubHashHash, header.SubSigHash, header.TxRoot} {
+		if len(hash) != HASH_SIZE {
+			return nil, ErrBlockHeader
+		}
+	}
+	data := make([]byte, 8, HEADER_SIZE)
+	binary.BigEndian.PutUint64(data, uint64(header.BlockId))
+	data = append(data, header.PrevHash...)
+	data = append(data, header.SubHashHash...)
+	data = append(data, header.SubSigHash...)
+	data = append(data, header.TxRoot...)
+	data = data[:HEADER_SIZE]
+	binary.BigEndian.PutUint64(data[HEADER_SIZE-8:], uint64(header.Timestamp))
+	return data, nil
+}
+
+// Hash of the canonical encoding, nil if the header is invalid
+func (header *Header) Hash() []byte {
+	if header == nil {
+		return nil
+	}
+	data, err := header.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return Sum32(data)
+}
+
+// Hash of the genesis block's predecessor
+func ZeroHash() []byte {
+	return make([]byte, HASH_SIZE)
+}
+
+// Checks the header commits to the block contents
+func (b *Block) CheckHeader() error {
+	header := b.Header
+	switch {
+	case header == nil,
+		b.SubHash == nil || b.SubSignature == nil || b.SubTx == nil,
+		header.BlockId != b.BlockId,
+		b.SubHash.BlockId != b.BlockId,
+		b.SubSignature.BlockId != b.BlockId,
+		b.SubTx.BlockId != b.BlockId,
+		header.Hash() == nil:
+		return ErrBlockHeader
+	}
+	expected := NewHeader(b.BlockId, header.PrevHash, b.SubHash, b.SubSignature, b.SubTx, header.Timestamp)
+	if !bytes.Equal(expected.Hash(), header.Hash()) {
+		return ErrBlockHeader
+	}
+	return nil
+}
+
+// Checks block links to prev, or is a genesis block if prev is nil
+func CheckLink(prev, b *Block) error {
+	if err := b.CheckHeader(); err != nil {
+		return err
+	}
+	prevHash := ZeroHash()
+	if prev != nil {
+		prevHash = prev.Hash()
+	}
+	if !bytes.Equal(b.Header.PrevHash, prevHash) {
+		return ErrPrevHash
+	}
+	timestamp := b.Header.Timestamp
+	if prev != nil && timestamp < prev.Header.Timestamp {
+		return ErrTimestamp
+	} else if timestamp > time.Now().Add(MAX_CLOCK_DRIFT).Unix() {
+		return ErrTimestamp
+	}
+	return nil
+}
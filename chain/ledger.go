@@ -0,0 +1,204 @@
+package chain
+
+import (
+	"bytes"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/crypto/tndr"
+	. "github.com/zbo14/pos/util"
+)
+
+// Ledger
+// The ledger tracks unspent payment outputs, keyed by the id of
+// the payment and the index of the output, and the ids of all txs
+// applied, so a tx cannot be included twice. Applying a block spends
+// the outputs referenced by the ins of its payments and adds their
+// outs. Each in must reference an unspent output with the in's
+// public key and carry a signature of the spending payment's outs
+// and the output it references, and a payment cannot spend more
+// than its ins are worth. Payments in the genesis block have no
+// ins, they allocate the initial outputs. Blocks are reverted in
+// the reverse order they were applied, e.g. by a block tree on
+// reorganization (see BlockTree.OnReorg).
+
+var (
+	ErrDoubleSpend   = Error("In references a spent output")
+	ErrInPubKey      = Error("In public key does not match output public key")
+	ErrInSignature   = Error("Invalid in signature")
+	ErrNoIns         = Error("Payment has no ins")
+	ErrOutValue      = Error("Output value must be positive")
+	ErrOverspend     = Error("Payment outs exceed ins")
+	ErrRevertOrder   = Error("Block is not the last block applied")
+	ErrUnknownOutput = Error("In references an unknown output")
+)
+
+type OutPoint struct {
+	Index  int    `json:"index"`
+	TxHash string `json:"tx_hash"`
+}
+
+// Changes made by applying a block, so it can be reverted
+type ledgerUndo struct {
+	created []OutPoint
+	hash    []byte
+	spent   []OutPoint
+	outs    []*Out // spent outputs
+	txIds   []string
+}
+
+type Ledger struct {
+	spent map[OutPoint]bool
+	txIds map[string]bool
+	undo  []*ledgerUndo
+	utxos map[OutPoint]*Out
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		spent: make(map[OutPoint]bool),
+		txIds: make(map[string]bool),
+		utxos: make(map[OutPoint]*Out),
+	}
+}
+
+// Unspent output, nil if it does not exist or was spent
+func (l *Ledger) Output(txHash []byte, index int) *Out {
+	return l.utxos[OutPoint{index, string(txHash)}]
+}
+
+// Whether a tx with the id was applied
+func (l *Ledger) HasTx(txId []byte) bool {
+	return l.txIds[string(txId)]
+}
+
+func (l *Ledger) NumOutputs() int {
+	return len(l.utxos)
+}
+
+// Sum of the unspent outputs with the public key
+func (l *Ledger) Balance(pub crypto.PubKeyEd25519) int64 {
+	var balance int64
+	for _, out := range l.utxos {
+		if out.PubKey == pub {
+			balance += out.Value
+		}
+	}
+	return balance
+}
+
+// Number of blocks applied
+func (l *Ledger) Height() int {
+	return len(l.undo)
+}
+
+// Applies the payments in a block
+// If a payment is invalid, the block is not applied
+func (l *Ledger) Apply(b *Block) error {
+	undo := &ledgerUndo{hash: b.Hash()}
+	for _, tx := range b.SubTx.Txs {
+		id := tx.Id()
+		if id == nil {
+			l.revert(undo)
+			return ErrTxEncoding
+		}
+		txId := string(id)
+		if l.txIds[txId] {
+			l.revert(undo)
+			return ErrDuplicateTx
+		}
+		if tx.TxPayment != nil {
+			if err := l.applyPayment(tx.TxPayment, txId, b.BlockId == 0, undo); err != nil {
+				l.revert(undo)
+				return err
+			}
+		}
+		l.txIds[txId] = true
+		undo.txIds = append(undo.txIds, txId)
+	}
+	l.undo = append(l.undo, undo)
+	return nil
+}
+
+func (l *Ledger) MustApply(b *Block) {
+	err := l.Apply(b)
+	Check(err)
+}
+
+func (l *Ledger) applyPayment(payment *TxPayment, txId string, genesis bool, undo *ledgerUndo) error {
+	if len(payment.Ins) == 0 && !genesis {
+		return ErrNoIns
+	}
+	var total int64
+	for _, out := range payment.Outs {
+		if out.Value <= 0 || total+out.Value < total {
+			return ErrOutValue
+		}
+		total += out.Value
+	}
+	var value int64
+	spent := make(map[OutPoint]bool)
+	for _, in := range payment.Ins {
+		point := OutPoint{in.Index, string(in.TxHash)}
+		out := l.utxos[point]
+		if spent[point] || l.spent[point] {
+			return ErrDoubleSpend
+		} else if out == nil {
+			return ErrUnknownOutput
+		}
+		if in.PubKey != out.PubKey {
+			return ErrInPubKey
+		}
+		inSign := NewInSign(in.Index, payment.Outs, in.PubKey, in.TxHash)
+		if !tndr.Verify(in.PubKey, inSign.Serialize(), in.Signature) {
+			return ErrInSignature
+		}
+		spent[point] = true
+		value += out.Value
+	}
+	if len(payment.Ins) > 0 && total > value {
+		return ErrOverspend
+	}
+	for _, in := range payment.Ins {
+		point := OutPoint{in.Index, string(in.TxHash)}
+		undo.spent = append(undo.spent, point)
+		undo.outs = append(undo.outs, l.utxos[point])
+		l.spent[point] = true
+		delete(l.utxos, point)
+	}
+	for i, out := range payment.Outs {
+		point := OutPoint{i, txId}
+		undo.created = append(undo.created, point)
+		l.utxos[point] = out
+	}
+	return nil
+}
+
+// Reverts the last block applied
+func (l *Ledger) Revert(b *Block) error {
+	n := len(l.undo)
+	if n == 0 || !bytes.Equal(l.undo[n-1].hash, b.Hash()) {
+		return ErrRevertOrder
+	}
+	l.revert(l.undo[n-1])
+	l.undo = l.undo[:n-1]
+	return nil
+}
+
+func (l *Ledger) MustRevert(b *Block) {
+	err := l.Revert(b)
+	Check(err)
+}
+
+// Outputs spent in the block they were created in are
+// restored then deleted, so spends are undone first
+func (l *Ledger) revert(undo *ledgerUndo) {
+	for i, point := range undo.spent {
+		delete(l.spent, point)
+		l.utxos[point] = undo.outs[i]
+	}
+	for _, point := range undo.created {
+		delete(l.utxos, point)
+	}
+	for _, txId := range undo.txIds {
+		delete(l.txIds, txId)
+	}
+}
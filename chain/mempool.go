@@ -0,0 +1,68 @@
+package chain
+
+import (
+	. "github.com/zbo14/pos/util"
+)
+
+// Mempool holds txs waiting to be included in a block,
+// in the order they were added, keyed by tx id
+
+type Mempool struct {
+	txIds map[string]bool
+	txs   []*Tx
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		txIds: make(map[string]bool),
+	}
+}
+
+func (pool *Mempool) Add(tx *Tx) error {
+	id := tx.Id()
+	if id == nil {
+		return ErrTxEncoding
+	}
+	txId := string(id)
+	if pool.txIds[txId] {
+		return ErrDuplicateTx
+	}
+	pool.txIds[txId] = true
+	pool.txs = append(pool.txs, tx)
+	return nil
+}
+
+func (pool *Mempool) MustAdd(tx *Tx) {
+	err := pool.Add(tx)
+	Check(err)
+}
+
+func (pool *Mempool) Has(txId []byte) bool {
+	return pool.txIds[string(txId)]
+}
+
+func (pool *Mempool) Len() int {
+	return len(pool.txs)
+}
+
+func (pool *Mempool) Txs() []*Tx {
+	return pool.txs
+}
+
+// Removes the txs included in a block
+func (pool *Mempool) Remove(b *Block) {
+	included := make(map[string]bool)
+	for _, tx := range b.SubTx.Txs {
+		included[string(tx.Id())] = true
+	}
+	var txs []*Tx
+	for _, tx := range pool.txs {
+		txId := string(tx.Id())
+		if included[txId] {
+			delete(pool.txIds, txId)
+		} else {
+			txs = append(txs, tx)
+		}
+	}
+	pool.txs = txs
+}
@@ -0,0 +1,330 @@
+package chain
+
+import (
+	proto "github.com/zbo14/pos/protocol"
+	. "github.com/zbo14/pos/util"
+	"math"
+)
+
+// Block tree
+// Competing branches are kept in a tree rooted at the genesis block.
+// Proof quality is Spacemint's (see protocol.Quality), but the block
+// weight is a rule of this package, not the chain quality defined in
+// the Spacemint paper. A block is weighted by the space its proof
+// quality implies: a space of N labels has log quality at least q
+// with probability 1/2 when N = -ln(2)/q. That space is heavy tailed
+// across blocks, so a block's weight is log(1+N), which grows with
+// the space but does not let one lucky block outweigh a branch.
+// The quality of a branch is the sum of the weights of its blocks,
+// and the head is the tip of the branch with the highest quality.
+// Ties keep the current head, so the first branch seen wins.
+// Blocks are validated before they are weighed, since the
+// weight trusts the space proof, so the tree needs a verifier.
+// When the head moves to another branch, the blocks after the
+// fork point are reverted from the old head down, then the blocks
+// of the new branch are applied from the fork point up.
+// If a block fails to apply, the blocks applied so far are
+// reverted, the old branch is applied again and the block and
+// its descendants are removed from the tree and marked invalid.
+// A failing callback must leave its own state unchanged. If a
+// callback also fails while changes are rolled back, the rollback
+// stops and both failures are returned in an ErrRollback, since
+// the callbacks may no longer match the main chain.
+
+var (
+	ErrBlockExists  = Error("Block is already in the tree")
+	ErrBlockWeight  = Error("Block weight is not finite")
+	ErrInvalidBlock = Error("Block or its parent failed to apply")
+	ErrNoVerifier   = Error("Block tree requires a verifier")
+	ErrOrphanBlock  = Error("Block parent is not in the tree")
+)
+
+// Wraps the error that started a rollback and the error it failed with
+type ErrRollback struct {
+	Err      error
+	Rollback error
+}
+
+func (err *ErrRollback) Error() string {
+	return Sprintf("%v; rollback failed: %v", err.Err, err.Rollback)
+}
+
+// Returns err, or an ErrRollback if undo fails
+func rollback(err error, undo func() error) error {
+	if rollbackErr := undo(); rollbackErr != nil {
+		return &ErrRollback{err, rollbackErr}
+	}
+	return err
+}
+
+type treeNode struct {
+	block   *Block
+	parent  *treeNode
+	quality float64 // cumulative
+}
+
+// Called with blocks applied to and reverted from the main chain
+type reorgCallbacks struct {
+	apply  func(*Block) error
+	revert func(*Block) error
+}
+
+type BlockTree struct {
+	callbacks []reorgCallbacks
+	head      *treeNode
+	invalid   map[string]bool
+	nodes     map[string]*treeNode
+	verifier  *proto.Verifier
+}
+
+func NewBlockTree(genesis *Block, verifier *proto.Verifier) (*BlockTree, error) {
+	if verifier == nil {
+		return nil, ErrNoVerifier
+	}
+	t := &BlockTree{
+		invalid:  make(map[string]bool),
+		nodes:    make(map[string]*treeNode),
+		verifier: verifier,
+	}
+	weight, err := t.validate(nil, genesis)
+	if err != nil {
+		return nil, err
+	}
+	t.head = &treeNode{
+		block:   genesis,
+		quality: weight,
+	}
+	t.nodes[string(genesis.Hash())] = t.head
+	return t, nil
+}
+
+func MustNewBlockTree(genesis *Block, verifier *proto.Verifier) *BlockTree {
+	t, err := NewBlockTree(genesis, verifier)
+	Check(err)
+	return t
+}
+
+// Log of 1 plus the space implied by the block's proof quality,
+// 0 without a space proof
+// The space proof must be verified, the weight trusts its size
+func BlockWeight(b *Block) float64 {
+	spaceProof := b.SubHash.SpaceProof
+	if spaceProof == nil || spaceProof.Size < 1 {
+		return 0
+	}
+	space := -math.Ln2 / proto.Quality(spaceProof, spaceProof.Size)
+	return math.Log1p(space)
+}
+
+// Returns the weight of a valid block
+func (t *BlockTree) validate(prev, b *Block) (float64, error) {
+	if err := ValidateBlock(prev, b, t.verifier); err != nil {
+		return 0, err
+	}
+	weight := BlockWeight(b)
+	if math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return 0, ErrBlockWeight
+	}
+	return weight, nil
+}
+
+// Apply is called with each block applied to the main chain and
+// revert with each block reverted from it, e.g. a ledger's methods.
+// Callbacks are applied in the order they were added and reverted
+// in the reverse order. The main chain, starting with the genesis
+// block, is applied when the callbacks are added. If a block fails
+// to apply, the blocks before it are reverted and the callbacks
+// are not added.
+func (t *BlockTree) OnReorg(apply, revert func(*Block) error) error {
+	blocks := t.MainChain()
+	for i, b := range blocks {
+		if err := apply(b); err != nil {
+			return rollback(err, func() error {
+				for j := i - 1; j >= 0; j-- {
+					if err := revert(blocks[j]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+	t.callbacks = append(t.callbacks, reorgCallbacks{apply, revert})
+	return nil
+}
+
+func (t *BlockTree) MustOnReorg(apply, revert func(*Block) error) {
+	err := t.OnReorg(apply, revert)
+	Check(err)
+}
+
+// Adds a block to the tree and moves the head
+// if the block's branch has the highest quality
+func (t *BlockTree) Add(b *Block) error {
+	if b.Header == nil {
+		return ErrBlockHeader
+	}
+	hash := string(b.Hash())
+	if _, ok := t.nodes[hash]; ok {
+		return ErrBlockExists
+	} else if t.invalid[hash] || t.invalid[string(b.Header.PrevHash)] {
+		return ErrInvalidBlock
+	}
+	parent, ok := t.nodes[string(b.Header.PrevHash)]
+	if !ok {
+		return ErrOrphanBlock
+	}
+	weight, err := t.validate(parent.block, b)
+	if err != nil {
+		return err
+	}
+	n := &treeNode{
+		block:   b,
+		parent:  parent,
+		quality: parent.quality + weight,
+	}
+	t.nodes[hash] = n
+	if n.quality > t.head.quality {
+		return t.reorg(n)
+	}
+	return nil
+}
+
+func (t *BlockTree) MustAdd(b *Block) {
+	err := t.Add(b)
+	Check(err)
+}
+
+// Moves the head to n, calling back for reverted and applied blocks
+// The head does not move if a block fails to revert or apply
+func (t *BlockTree) reorg(n *treeNode) error {
+	var reverted, applied []*Block
+	old, head := t.head, n
+	for old != n {
+		if old.block.BlockId >= n.block.BlockId {
+			reverted = append(reverted, old.block)
+			old = old.parent
+		} else {
+			applied = append(applied, n.block)
+			n = n.parent
+		}
+	}
+	reapply := func(reverted []*Block) error {
+		for j := len(reverted) - 1; j >= 0; j-- {
+			if err := t.apply(reverted[j]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, b := range reverted {
+		if err := t.revert(b); err != nil {
+			return rollback(err, func() error {
+				return reapply(reverted[:i])
+			})
+		}
+	}
+	for i := len(applied) - 1; i >= 0; i-- {
+		if err := t.apply(applied[i]); err != nil {
+			t.invalidate(applied[i])
+			return rollback(err, func() error {
+				for j := i + 1; j < len(applied); j++ {
+					if err := t.revert(applied[j]); err != nil {
+						return err
+					}
+				}
+				return reapply(reverted)
+			})
+		}
+	}
+	t.head = head
+	return nil
+}
+
+// Applies a block with each callback, or none of them
+func (t *BlockTree) apply(b *Block) error {
+	for i, callbacks := range t.callbacks {
+		if err := callbacks.apply(b); err != nil {
+			return rollback(err, func() error {
+				for j := i - 1; j >= 0; j-- {
+					if err := t.callbacks[j].revert(b); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// Reverts a block with each callback, or none of them
+func (t *BlockTree) revert(b *Block) error {
+	for i := len(t.callbacks) - 1; i >= 0; i-- {
+		if err := t.callbacks[i].revert(b); err != nil {
+			return rollback(err, func() error {
+				for j := i + 1; j < len(t.callbacks); j++ {
+					if err := t.callbacks[j].apply(b); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// Removes a block and its descendants from the tree
+func (t *BlockTree) invalidate(b *Block) {
+	invalid := t.nodes[string(b.Hash())]
+	for hash, n := range t.nodes {
+		for ; n != nil && n.block.BlockId >= b.BlockId; n = n.parent {
+			if n == invalid {
+				delete(t.nodes, hash)
+				t.invalid[hash] = true
+				break
+			}
+		}
+	}
+}
+
+func (t *BlockTree) Head() *Block {
+	return t.head.block
+}
+
+// Cumulative quality of the main chain
+func (t *BlockTree) Quality() float64 {
+	return t.head.quality
+}
+
+// Cumulative quality of the branch ending in the block with hash
+func (t *BlockTree) QualityOf(hash []byte) (float64, error) {
+	n, ok := t.nodes[string(hash)]
+	if !ok {
+		return 0, ErrBlockNotFound
+	}
+	return n.quality, nil
+}
+
+func (t *BlockTree) Get(hash []byte) (*Block, error) {
+	n, ok := t.nodes[string(hash)]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return n.block, nil
+}
+
+// Number of blocks in the tree
+func (t *BlockTree) Len() int {
+	return len(t.nodes)
+}
+
+// Blocks from the genesis block to the head
+func (t *BlockTree) MainChain() []*Block {
+	blocks := make([]*Block, t.head.block.BlockId+1)
+	for n := t.head; n != nil; n = n.parent {
+		blocks[n.block.BlockId] = n.block
+	}
+	return blocks
+}
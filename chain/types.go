@@ -3,8 +3,10 @@ package chain
 import (
 	"github.com/tendermint/go-crypto"
 	"github.com/zbo14/pos/crypto/tndr"
+	"github.com/zbo14/pos/merkle"
 	proto "github.com/zbo14/pos/protocol"
 	. "github.com/zbo14/pos/util"
+	"time"
 )
 
 // Following the Spacemint specification..
@@ -13,6 +15,7 @@ import (
 
 type Block struct {
 	BlockId      int64         `json:"block_id"`
+	Header       *Header       `json:"header"`
 	SubHash      *SubHash      `json:"hash_sub"`
 	SubSignature *SubSignature `json:"signature_sub"`
 	SubTx        *SubTx        `json:"tx_sub"`
@@ -22,13 +25,20 @@ func (b *Block) Serialize() []byte {
 	return MarshalJSON(b)
 }
 
+// Hash of the block header
+func (b *Block) Hash() []byte {
+	return b.Header.Hash()
+}
+
 func NewBlock(commitProof *proto.CommitProof, prevBlock *Block, priv crypto.PrivKeyEd25519, spaceProof *proto.SpaceProof, txs []*Tx) *Block {
 	blockId := prevBlock.BlockId + 1
 	subHash := NewSubHash(blockId, commitProof, prevBlock.SubHash, priv, spaceProof)
 	subTx := NewSubTx(blockId, txs)
 	subSig := NewSubSignature(blockId, prevBlock.SubSignature, priv, subTx)
+	header := NewHeader(blockId, prevBlock.Hash(), subHash, subSig, subTx, time.Now().Unix())
 	return &Block{
 		BlockId:      blockId,
+		Header:       header,
 		SubHash:      subHash,
 		SubSignature: subSig,
 		SubTx:        subTx,
@@ -40,8 +50,10 @@ func GenesisBlock(commitProof *proto.CommitProof, priv crypto.PrivKeyEd25519, sp
 	subHash := NewSubHash(blockId, commitProof, nil, priv, spaceProof) //pass nil ptr to prevSubHash
 	subTx := NewSubTx(blockId, txs)
 	subSig := NewSubSignature(blockId, nil, priv, subTx) //pass nil ptr to prevSubSignature
+	header := NewHeader(blockId, ZeroHash(), subHash, subSig, subTx, time.Now().Unix())
 	return &Block{
 		BlockId:      blockId,
+		Header:       header,
 		SubHash:      subHash,
 		SubSignature: subSig,
 		SubTx:        subTx,
@@ -107,6 +119,17 @@ func (subTx *SubTx) Serialize() []byte {
 	return MarshalJSON(subTx)
 }
 
+// Merkle root of the canonical tx encodings,
+// an invalid tx is appended as an empty leaf
+func (subTx *SubTx) TxRoot() []byte {
+	acc := merkle.NewAccumulator()
+	for _, tx := range subTx.Txs {
+		data, _ := tx.MarshalBinary()
+		acc.Append(data)
+	}
+	return acc.Root()
+}
+
 func NewSubTx(blockId int64, txs []*Tx) *SubTx {
 	return &SubTx{
 		BlockId: blockId,
@@ -115,10 +138,26 @@ func NewSubTx(blockId int64, txs []*Tx) *SubTx {
 }
 
 // Tx
+// Exactly one of the fields is set. They are not embedded,
+// since the embedded public keys would collide in JSON
 type Tx struct {
-	*TxCommit
-	*TxPayment
-	*TxPunishment
+	TxCommit     *TxCommit     `json:"commit,omitempty"`
+	TxPayment    *TxPayment    `json:"payment,omitempty"`
+	TxPunishment *TxPunishment `json:"punishment,omitempty"`
+}
+
+func (tx *Tx) Serialize() []byte {
+	return MarshalJSON(tx)
+}
+
+// Tx id is the hash of the canonical encoding (see codec.go),
+// nil if the tx is invalid
+func (tx *Tx) Id() []byte {
+	data, err := tx.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return Sum32(data)
 }
 
 func NewTx(isTx IsTx) *Tx {
@@ -144,42 +183,36 @@ type IsTx interface {
 type TxCommit struct {
 	Commit []byte               `json:"commit"`
 	PubKey crypto.PubKeyEd25519 `json:"public_key"`
-	TxId   int64                `json:"tx_id"`
 }
 
-func NewTxCommit(commit []byte, pub crypto.PubKeyEd25519, txId int64) *TxCommit {
+func NewTxCommit(commit []byte, pub crypto.PubKeyEd25519) *TxCommit {
 	return &TxCommit{
 		Commit: commit,
 		PubKey: pub,
-		TxId:   txId,
 	}
 }
 
 type TxPayment struct {
 	Ins  []*In  `json:"ins"`
 	Outs []*Out `json:"outs"`
-	TxId int64  `json:"tx_id"`
 }
 
-func NewTxPayment(ins []*In, outs []*Out, txId int64) *TxPayment {
+func NewTxPayment(ins []*In, outs []*Out) *TxPayment {
 	return &TxPayment{
 		Ins:  ins,
 		Outs: outs,
-		TxId: txId,
 	}
 }
 
 type TxPunishment struct {
 	PubKey     crypto.PubKeyEd25519 `json:"public_key"`
 	Punishment *Punishment          `json:"punishment"`
-	TxId       int64                `json:"tx_id"`
 }
 
-func NewTxPunishment(pub crypto.PubKeyEd25519, punishment *Punishment, txId int64) *TxPunishment {
+func NewTxPunishment(pub crypto.PubKeyEd25519, punishment *Punishment) *TxPunishment {
 	return &TxPunishment{
 		PubKey:     pub,
 		Punishment: punishment,
-		TxId:       txId,
 	}
 }
 
@@ -221,25 +254,29 @@ func (_ *TxCommit) IsTx()     {}
 func (_ *TxPayment) IsTx()    {}
 func (_ *TxPunishment) IsTx() {}
 
+// In spends output Index of the payment with TxHash
+// The spending payment's id is the hash of the payment,
+// including its ins, so the in signature cannot cover it
 type In struct {
+	Index     int                     `json:"index"`
 	PubKey    crypto.PubKeyEd25519    `json:"public_key"`
-	Signature crypto.SignatureEd25519 `json:"signature"` //sig(tx_id, past_tx_id, past_beneficiary, out)
-	TxId      int64                   `json:"tx_id"`
+	Signature crypto.SignatureEd25519 `json:"signature"` //sig(index, out, past_beneficiary, past_tx_hash)
+	TxHash    []byte                  `json:"tx_hash"`
 }
 
 type InSign struct {
-	Outs     []*Out               `json:"out"`
-	PastTxId int64                `json:"past_tx_id"`
-	Pubkey   crypto.PubKeyEd25519 `json:"public_key"`
-	TxId     int64                `json:"tx_id"`
+	Index  int                  `json:"index"`
+	Outs   []*Out               `json:"out"`
+	Pubkey crypto.PubKeyEd25519 `json:"public_key"`
+	TxHash []byte               `json:"tx_hash"`
 }
 
-func NewInSign(outs []*Out, pastTxId int64, pub crypto.PubKeyEd25519, txId int64) *InSign {
+func NewInSign(index int, outs []*Out, pub crypto.PubKeyEd25519, txHash []byte) *InSign {
 	return &InSign{
-		Outs:     outs,
-		PastTxId: pastTxId,
-		Pubkey:   pub,
-		TxId:     txId,
+		Index:  index,
+		Outs:   outs,
+		Pubkey: pub,
+		TxHash: txHash,
 	}
 }
 
@@ -247,14 +284,15 @@ func (inSign *InSign) Serialize() []byte {
 	return MarshalJSON(inSign)
 }
 
-func NewIn(outs []*Out, pastTxId int64, priv crypto.PrivKeyEd25519, pub crypto.PubKeyEd25519, txId int64) *In {
-	inSign := NewInSign(outs, pastTxId, pub, txId)
+func NewIn(index int, outs []*Out, priv crypto.PrivKeyEd25519, pub crypto.PubKeyEd25519, txHash []byte) *In {
+	inSign := NewInSign(index, outs, pub, txHash)
 	data := inSign.Serialize()
 	signature := tndr.Sign(priv, data)
 	return &In{
+		Index:     index,
 		PubKey:    pub,
 		Signature: signature,
-		TxId:      txId,
+		TxHash:    txHash,
 	}
 }
 
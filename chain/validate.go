@@ -0,0 +1,121 @@
+package chain
+
+import (
+	"bytes"
+	"github.com/zbo14/pos/crypto/tndr"
+	proto "github.com/zbo14/pos/protocol"
+	. "github.com/zbo14/pos/util"
+)
+
+// Block validation
+// A block is valid after prev (nil for the genesis block) when
+// (1) its header commits to its contents and links to prev
+// (2) its block id follows prev's block id
+// (3) both proofs are present and from the same public key
+//     and commitment
+// (4) the sub hash signature, over prev's sub hash, and the
+//     sub signature signatures, over prev's sub signature and
+//     the block's sub tx, verify with that public key
+// (5) both proofs use the seed derived from prev and verify
+//     against the registered commitment
+// (6) every tx has a canonical encoding and no two
+//     txs in the block have the same id
+
+var (
+	ErrBlockId        = Error("Block id does not follow the previous block id")
+	ErrMissingProof   = Error("Block is missing a commit or space proof")
+	ErrProofPubKey    = Error("Commit and space proofs have different public keys")
+	ErrSubHashSig     = Error("Invalid signature in sub hash")
+	ErrSubSigSig      = Error("Invalid signature of previous sub signature")
+	ErrTxSig          = Error("Invalid signature of sub tx")
+	ErrCommitMismatch = Error("Commit and space proofs have different commits")
+	ErrDuplicateTx    = Error("Tx with id already exists")
+	ErrSeed           = Error("Proof seed is not derived from the previous block")
+)
+
+// Wraps the error from verifying a commit or space proof
+type ErrInvalidProof struct {
+	Err   error
+	Proof string
+}
+
+func (err *ErrInvalidProof) Error() string {
+	return Sprintf("Invalid %s proof: %v", err.Proof, err.Err)
+}
+
+// Seed for the proofs in the block after prev
+// It is the hash of prev's sub hash, which chains the proofs
+// and signatures of all its ancestors but not their txs or
+// timestamps, so a prover cannot grind the seed by varying
+// block contents. The genesis block's seed is the hash of nil.
+// The hash is extended to the seed size in the params.
+func NextSeed(prev *Block, size int) []byte {
+	seed := make([]byte, size)
+	if prev == nil {
+		Shake32(seed, nil)
+	} else {
+		Shake32(seed, prev.SubHash.Serialize())
+	}
+	return seed
+}
+
+// Takes the verifier, not just its params, since proofs are
+// checked against the commitments registered with it and the
+// public keys they were registered with
+func ValidateBlock(prev, b *Block, verifier *proto.Verifier) error {
+	if err := CheckLink(prev, b); err != nil {
+		return err
+	}
+	var prevSubHash *SubHash
+	var prevSubSig *SubSignature
+	blockId := int64(0)
+	if prev != nil {
+		prevSubHash, prevSubSig = prev.SubHash, prev.SubSignature
+		blockId = prev.BlockId + 1
+	}
+	if b.BlockId != blockId {
+		return ErrBlockId
+	}
+	commitProof, spaceProof := b.SubHash.CommitProof, b.SubHash.SpaceProof
+	if commitProof == nil || spaceProof == nil {
+		return ErrMissingProof
+	}
+	pub := spaceProof.PubKey
+	if commitProof.PubKey != pub {
+		return ErrProofPubKey
+	} else if !bytes.Equal(commitProof.Commit, spaceProof.Commit) {
+		return ErrCommitMismatch
+	}
+	seed := NextSeed(prev, verifier.Params().SeedSize)
+	if !bytes.Equal(commitProof.Seed, seed) || !bytes.Equal(spaceProof.Seed, seed) {
+		return ErrSeed
+	}
+	if !tndr.Verify(pub, prevSubHash.Serialize(), b.SubHash.Signature) {
+		return ErrSubHashSig
+	}
+	if !tndr.Verify(pub, prevSubSig.Serialize(), b.SubSignature.SignatureSig) {
+		return ErrSubSigSig
+	}
+	if !tndr.Verify(pub, b.SubTx.Serialize(), b.SubSignature.SignatureTx) {
+		return ErrTxSig
+	}
+	if err := verifier.VerifyCommit(commitProof); err != nil {
+		return &ErrInvalidProof{err, "commit"}
+	}
+	if err := verifier.VerifySpace(spaceProof); err != nil {
+		return &ErrInvalidProof{err, "space"}
+	}
+	txIds := make(map[string]bool)
+	for _, tx := range b.SubTx.Txs {
+		id := tx.Id()
+		if id == nil {
+			return ErrTxEncoding
+		}
+		txId := string(id)
+		if txIds[txId] {
+			return ErrDuplicateTx
+		}
+		txIds[txId] = true
+	}
+	return nil
+}
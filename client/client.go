@@ -7,23 +7,26 @@ import (
 	"github.com/zbo14/pos/p2p"
 	proto "github.com/zbo14/pos/protocol"
 	. "github.com/zbo14/pos/util"
+	"math"
 	"time"
 )
 
 const (
-	DELTA   = 50 // suggested from Spacemint paper
-	TIMEOUT = 10 * time.Second
+	CACHE_LEVELS = 12
+	TIMEOUT      = 10 * time.Second
 )
 
 type Client struct {
-	blocks   chan *chain.Block
-	Chain    *chain.Chain
-	Delta    int
-	Node     *p2p.Node
-	Prover   *proto.Prover
-	seed     []byte
-	Txs      []*chain.Tx
-	Verifier *proto.Verifier
+	blocks      chan *chain.Block
+	Chain       *chain.Chain
+	CommitProof *proto.CommitProof
+	Mempool     *chain.Mempool
+	Node        *p2p.Node
+	Prover      *proto.Prover
+	sector      *proto.Sector
+	seed        []byte
+	session     *proto.Session
+	Verifier    *proto.Verifier
 }
 
 func Configure(priv crypto.PrivKeyEd25519) {
@@ -31,15 +34,17 @@ func Configure(priv crypto.PrivKeyEd25519) {
 	p2p.NewConfig("", "", "", "", "", priv, "", 0)
 }
 
-func NewClient(chainPath, password string) *Client {
-	chain := chain.NewChain(chainPath)
+func NewClient(chainPath, password string, params *proto.Params) *Client {
+	c := chain.MustOpenChain(chainPath)
 	priv := tndr.GeneratePrivKey(password)
 	// Configure(priv)
-	prover := proto.NewProver(priv)
-	verifier := proto.NewVerifier()
+	prover := proto.NewProver(priv, params)
+	err := prover.CacheLevels(CACHE_LEVELS)
+	Check(err)
+	verifier := proto.NewVerifier(params)
 	return &Client{
-		Chain:    chain,
-		Delta:    DELTA,
+		Chain:    c,
+		Mempool:  chain.NewMempool(),
 		Prover:   prover,
 		Verifier: verifier,
 	}
@@ -49,85 +54,74 @@ func (cli *Client) Init(configPath string, id int) {
 	if cli.Prover == nil {
 		panic("Prover is not set")
 	}
-	// Set merkle tree
-	cli.Prover.MerkleTree(id)
-	// Construct graph -- defaults to stacked expander
-	// TODO: add modularity
-	cli.Prover.GraphStackedExpanders(id)
-	// Commit
-	// (1) Set graph values
-	// (2) Add leaves to merkle tree
-	// (3) Hash levels of merkle tree
-	// (4) Set commit to root hash
-	cli.Prover.MakeCommit()
-	// Create TxCommit
-	commit := cli.Prover.Commit
+	// Construct graph from params and commit to it
+	sector, err := cli.Prover.AddSector(id)
+	Check(err)
+	cli.sector = sector
+	// Register and start session with our commit
+	commit := sector.Commit
 	pub := cli.Prover.PubKey()
-	txCommit := chain.NewTxCommit(commit, pub, 0) // what should txId be?
+	err = cli.Verifier.Register(commit, pub)
+	Check(err)
+	session, err := cli.Verifier.NewSession(commit, pub)
+	Check(err)
+	cli.session = session
+	// Prove and verify commit
+	cli.CommitProof = cli.MineCommit(sector)
+	err = cli.VerifyCommit(cli.CommitProof)
+	Check(err)
+	// Create TxCommit
+	txCommit := chain.NewTxCommit(commit, pub)
 	tx := chain.NewTx(txCommit)
-	cli.Txs = append(cli.Txs, tx)
+	err = cli.Mempool.Add(tx)
+	Check(err)
 	// Run node
 	// cli.Node = p2p.RunNode(configPath)
 }
 
-func (cli *Client) MineCommit() *proto.CommitProof {
+// Proofs are non-interactive so peers
+// can verify them given only our commit
+
+func (cli *Client) MineCommit(sector *proto.Sector) *proto.CommitProof {
 	seed := cli.Seed()
-	challenges := cli.CommitChallenges(seed)
-	commitProof := cli.ProveCommit(challenges)
-	commitProof.Seed = cli.seed
-	return commitProof
+	return sector.ProveCommitNI(seed)
 }
 
-func (cli *Client) MineSpace() *proto.SpaceProof {
+// Space proof from our best sector, which
+// proves its commit in the same block
+func (cli *Client) MineSpace() (*proto.Sector, *proto.SpaceProof) {
 	seed := cli.Seed()
-	challenges := cli.SpaceChallenges(seed)
-	spaceProof := cli.ProveSpace(challenges)
-	spaceProof.Seed = cli.seed
-	return spaceProof
+	spaceProof, err := cli.Prover.ProveSpaceNI(seed)
+	Check(err)
+	sector, err := cli.Prover.Sector(spaceProof.Commit)
+	Check(err)
+	return sector, spaceProof
 }
 
+// Log quality of a proof, -Inf if it does not verify
+
 func (cli *Client) CommitQuality(commitProof *proto.CommitProof) float64 {
 	if err := cli.VerifyCommit(commitProof); err != nil {
-		return 0
+		return math.Inf(-1)
 	}
-	hash := NewHash()
-	for _, p := range commitProof.Proofs {
-		hash.Write(p.Value)
-	}
-	data := hash.Sum(nil)
-	float := BytesToFloat(data)
-	graphSize := cli.Verifier.GraphSize()
-	num, _ := BigPow(float, graphSize).Float64()
-	den := Exp2(float64(1<<8) / float64(graphSize))
-	quality := num / den
-	return quality
+	return proto.Quality(commitProof, commitProof.Size)
 }
 
 func (cli *Client) SpaceQuality(spaceProof *proto.SpaceProof) float64 {
 	if err := cli.VerifySpace(spaceProof); err != nil {
-		return 0
-	}
-	hash := NewHash()
-	for _, p := range spaceProof.Proofs {
-		hash.Write(p.Value)
+		return math.Inf(-1)
 	}
-	data := hash.Sum(nil)
-	float := BytesToFloat(data)
-	graphSize := cli.Verifier.GraphSize()
-	num, _ := BigPow(float, graphSize).Float64()
-	den := Exp2(float64(1<<8) / float64(graphSize))
-	quality := num / den
-	return quality
+	return proto.Quality(spaceProof, spaceProof.Size)
 }
 
 // Prover
 
 func (cli *Client) ProveCommit(challenges Int64s) *proto.CommitProof {
-	return cli.Prover.ProveCommit(challenges)
+	return cli.sector.ProveCommit(challenges)
 }
 
 func (cli *Client) ProveSpace(challenges Int64s) *proto.SpaceProof {
-	return cli.Prover.ProveSpace(challenges)
+	return cli.sector.ProveSpace(challenges)
 }
 
 func (cli *Client) PrivKey() crypto.PrivKeyEd25519 {
@@ -137,43 +131,40 @@ func (cli *Client) PrivKey() crypto.PrivKeyEd25519 {
 // Verifier
 
 func (cli *Client) CommitChallenges(seed []byte) Int64s {
-	challenges, err := cli.Verifier.CommitChallenges(seed)
+	challenges, err := cli.session.CommitChallenges(seed)
 	Check(err)
 	return challenges
 }
 
 func (cli *Client) SpaceChallenges(seed []byte) Int64s {
-	challenges, err := cli.Verifier.SpaceChallenges(seed)
+	challenges, err := cli.session.SpaceChallenges(seed)
 	Check(err)
 	return challenges
 }
 
 func (cli *Client) VerifyCommit(commitProof *proto.CommitProof) error {
-	return cli.Verifier.VerifyCommit(commitProof)
+	return cli.session.VerifyCommitNI(commitProof)
 }
 
+// Space proofs can come from any registered sector
 func (cli *Client) VerifySpace(spaceProof *proto.SpaceProof) error {
 	return cli.Verifier.VerifySpace(spaceProof)
 }
 
 //..
 
+// Seed the next block's proofs must use, see chain.NextSeed
 func (cli *Client) Seed() []byte {
-	id := cli.Chain.Last()
-	var data []byte //nil
-	if id >= 0 {
-		if id >= cli.Delta {
-			id -= cli.Delta // -1??
-		}
-		b := cli.Chain.MustRead(id)
-		data = b.Serialize()
+	var prev *chain.Block // nil before the genesis block
+	if last := cli.Chain.Last(); last >= 0 {
+		prev = cli.Chain.MustRead(last)
 	}
-	cli.seed = Sum64(data)
+	cli.seed = chain.NextSeed(prev, cli.Verifier.Params().SeedSize)
 	return cli.seed
 }
 
 func (cli *Client) Round() {
-	spaceProof := cli.MineSpace()
+	sector, spaceProof := cli.MineSpace()
 	quality := cli.SpaceQuality(spaceProof)
 	for {
 		select {
@@ -195,11 +186,13 @@ func (cli *Client) Round() {
 	lastb := cli.Chain.MustRead(last)
 	// Get privkey
 	priv := cli.PrivKey()
-	// Generate commit proof (if we're creating new block?)
-	commitProof := cli.MineCommit()
-	// Create new block
-	newb := chain.NewBlock(commitProof, lastb, priv, spaceProof, cli.Txs)
+	// Commit proof from the sector of the space proof
+	cli.CommitProof = cli.MineCommit(sector)
+	newb := chain.NewBlock(cli.CommitProof, lastb, priv, spaceProof, cli.Mempool.Txs())
 	//---- For testing ----//
 	cli.Chain.MustWrite(newb)
+	cli.Mempool.Remove(newb)
+	// The next round's seed is known once the block is written
+	cli.Prover.Precompute(cli.Seed())
 	// TODO: send new_block to peers in network
 }
@@ -2,7 +2,9 @@ package client
 
 import (
 	"github.com/zbo14/pos/chain"
+	proto "github.com/zbo14/pos/protocol"
 	. "github.com/zbo14/pos/util"
+	"os"
 	"testing"
 )
 
@@ -14,21 +16,24 @@ const (
 )
 
 func TestClient(t *testing.T) {
+	os.Remove(CHAIN_PATH)
 	// Create new client
-	cli := NewClient(CHAIN_PATH, PASSWORD)
+	params := proto.DefaultParams()
+	cli := NewClient(CHAIN_PATH, PASSWORD, params)
 	// Init client
 	cli.Init(CONFIG_PATH, ID)
+	// Commit proof is mined in Init
+	commitProof := cli.CommitProof
 	// Mine space proof
-	spaceProof := cli.MineSpace()
-	// Mine commit proof
-	commitProof := cli.MineCommit()
+	_, spaceProof := cli.MineSpace()
 	priv := cli.Prover.Priv
 	// Create genesis block
-	genesis := chain.GenesisBlock(commitProof, priv, spaceProof, cli.Txs)
+	genesis := chain.GenesisBlock(commitProof, priv, spaceProof, cli.Mempool.Txs())
 	// Write genesis block to chain
 	if err := cli.Chain.Write(genesis); err != nil {
 		t.Fatal(err.Error())
 	}
+	cli.Mempool.Remove(genesis)
 	// Generate new block in round
 	cli.Round()
 	// Read most recent block from chain
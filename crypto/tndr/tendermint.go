@@ -14,6 +14,10 @@ func Sign(priv crypto.PrivKeyEd25519, msg []byte) crypto.SignatureEd25519 {
 	return priv.Sign(msg).(crypto.SignatureEd25519)
 }
 
+func Verify(pub crypto.PubKeyEd25519, msg []byte, sig crypto.SignatureEd25519) bool {
+	return pub.VerifyBytes(msg, sig)
+}
+
 func GeneratePrivKey(password string) crypto.PrivKeyEd25519 {
 	secret, err := bcrypt.GenerateFromPassword([]byte(password), 0)
 	Check(err)
@@ -14,6 +14,10 @@ func DefaultDoubleButterfly(id int) *Graph {
 
 // Double Butterfly graph
 func ConstructDoubleButterfly(id int, g, l int64) *Graph {
+	return constructDoubleButterfly(graphPath(id, DOUBLE_BUTTERFLY), id, g, l)
+}
+
+func constructDoubleButterfly(path string, id int, g, l int64) *Graph {
 	if g < 1 {
 		panic("g cannot be less than 1")
 	}
@@ -22,7 +26,7 @@ func ConstructDoubleButterfly(id int, g, l int64) *Graph {
 	sectionSize := vertsPerRow * rowsPerSection
 	size := vertsPerRow * (l*(rowsPerSection-1) + 1)
 	bfly := new(DoubleButterfly)
-	bfly.Graph = NewGraph(id, size, DOUBLE_BUTTERFLY)
+	bfly.Graph = newGraph(path, id, size, DOUBLE_BUTTERFLY)
 	var i, j, k int64
 	var add bool
 	var nd *Node
@@ -24,11 +24,22 @@ type GraphType interface {
 type Graph struct {
 	batch *leveldb.Batch
 	db    *leveldb.DB
+	id    int
 	impl  GraphType
 	size  int64
 }
 
+// Default leveldb path of a graph
+func graphPath(id int, _type string) string {
+	return filepath.Join("Graph", _type, strconv.Itoa(id))
+}
+
 func NewGraph(id int, size int64, _type string) *Graph {
+	return newGraph(graphPath(id, _type), id, size, _type)
+}
+
+// Graph kept in the leveldb at path
+func newGraph(path string, id int, size int64, _type string) *Graph {
 	switch _type {
 	case DOUBLE_BUTTERFLY,
 		LINEAR_SUPER_CONCENTRATOR,
@@ -38,14 +49,22 @@ func NewGraph(id int, size int64, _type string) *Graph {
 	}
 	var err error
 	g := new(Graph)
-	path := filepath.Join("Graph", _type, strconv.Itoa(id))
 	g.batch = new(leveldb.Batch) //necessary?
 	g.db, err = leveldb.OpenFile(path, nil)
 	Check(err)
+	g.id = id
 	g.size = size
 	return g
 }
 
+func (g *Graph) Close() error {
+	return g.db.Close()
+}
+
+func (g *Graph) Id() int {
+	return g.id
+}
+
 func (g *Graph) Size() int64 {
 	return g.size
 }
@@ -97,28 +116,37 @@ func (g *Graph) writeBatch() {
 }
 
 // Initialize node values
-// value = hash(pubKey_bytes, idx, [parent1.Value, parent2.Value, ...])
+// value = hash(pubKey_bytes, graph_id, idx, [parent1.Value, parent2.Value, ...])
+// The graph id makes graphs labelled with the same key distinct
 
-func (g *Graph) SetValues(pub crypto.PubKeyEd25519) {
+func Label(pub crypto.PubKeyEd25519, id int, idx int64, parents [][]byte) []byte {
 	hash := NewHash()
-	pkbz := pub.Bytes()
+	hash.Write(pub.Bytes())
+	hash.Write(Int64Bytes(int64(id)))
+	hash.Write(Int64Bytes(idx))
+	for _, value := range parents {
+		hash.Write(value)
+	}
+	return hash.Sum(nil)
+}
+
+func (g *Graph) SetValues(pub crypto.PubKeyEd25519) {
 	var idx int64
 	for ; idx < g.size; idx++ {
 		nd := g.Get(idx)
-		bz := append(pkbz, Int64Bytes(idx)...)
+		var values [][]byte
 		if !nd.NoParents() {
 			sort.Sort(nd.Parents)
-			for _, p := range nd.Parents {
+			values = make([][]byte, len(nd.Parents))
+			for i, p := range nd.Parents {
 				parent := g.Get(p)
 				if parent.Value == nil {
 					Panicf("Cannot set value for idx=%d; parent idx=%d does not have value", nd.Idx, parent.Idx)
 				}
-				bz = append(bz, parent.Value...)
+				values[i] = parent.Value
 			}
 		}
-		hash.Reset()
-		hash.Write(bz)
-		nd.Value = hash.Sum(nil)
+		nd.Value = Label(pub, g.id, idx, values)
 		g.put(nd)
 	}
 }
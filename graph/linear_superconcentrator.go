@@ -17,6 +17,10 @@ func DefaultLinearSuperConcentrator(id int) *Graph {
 // Builds a linear superconcentrator with n inputs and n outputs
 
 func ConstructLinearSuperConcentrator(id int, n, k, d int64, localize bool) *Graph {
+	return constructLinearSuperConcentrator(graphPath(id, LINEAR_SUPER_CONCENTRATOR), id, n, k, d, localize)
+}
+
+func constructLinearSuperConcentrator(path string, id int, n, k, d int64, localize bool) *Graph {
 	var i, m, _n int64
 	if !PowOf2(n) {
 		panic("n must be a power of 2")
@@ -26,11 +30,11 @@ func ConstructLinearSuperConcentrator(id int, n, k, d int64, localize bool) *Gra
 	}
 	for m, _n = 0, n; i < k; i++ {
 		m += _n
-		_n *= (3 / 4)
+		_n = _n * 3 / 4
 	}
 	m = m*2 + _n
 	sup := new(LinearSuperConcentrator)
-	sup.Graph = NewGraph(id, m, LINEAR_SUPER_CONCENTRATOR)
+	sup.Graph = newGraph(path, id, m, LINEAR_SUPER_CONCENTRATOR)
 	Println(sup.size)
 	var idx, j int64
 	var nd *Node
@@ -59,7 +63,7 @@ func ConstructLinearSuperConcentrator(id int, n, k, d int64, localize bool) *Gra
 			}
 		}
 		m += _n
-		_n *= (3 / 4)
+		_n = _n * 3 / 4
 	}
 	// Finish perfect matching in middle section
 	for idx = m; idx < m+_n/2; {
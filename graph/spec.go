@@ -0,0 +1,134 @@
+package graph
+
+import . "github.com/zbo14/pos/util"
+
+// Graph type and construction parameters
+// Double butterfly: N=g, K=l
+// Linear superconcentrator: N=n, K=k, D=d, Localize
+// Stacked expanders: N=n, K=k, D=d, Localize
+
+type Spec struct {
+	D        int64  `json:"d"`
+	K        int64  `json:"k"`
+	Localize bool   `json:"localize"`
+	N        int64  `json:"n"`
+	Type     string `json:"type"`
+}
+
+func (spec *Spec) String() string {
+	return Sprintf("GRAPH_SPEC(type=%s,n=%d,k=%d,d=%d,localize=%v)", spec.Type, spec.N, spec.K, spec.D, spec.Localize)
+}
+
+func DefaultSpec(_type string) *Spec {
+	switch _type {
+	case DOUBLE_BUTTERFLY:
+		return &Spec{N: 3, K: 4, Type: _type}
+	case LINEAR_SUPER_CONCENTRATOR:
+		return &Spec{N: 256, K: 3, D: 4, Localize: true, Type: _type}
+	case STACKED_EXPANDERS:
+		return &Spec{N: 2048, K: 31, D: 5, Type: _type}
+	default:
+		panic("Invalid graph type: " + _type)
+	}
+}
+
+// Number of nodes, computed without constructing the graph
+func (spec *Spec) Size() int64 {
+	switch spec.Type {
+	case DOUBLE_BUTTERFLY:
+		g, l := spec.N, spec.K
+		return Pow2(g) * (l*(2*g-1) + 1)
+	case LINEAR_SUPER_CONCENTRATOR:
+		var i, m, _n int64
+		for m, _n = 0, spec.N; i < spec.K; i++ {
+			m += _n
+			_n = _n * 3 / 4
+		}
+		return m*2 + _n
+	case STACKED_EXPANDERS:
+		return spec.N * (spec.K + 1)
+	default:
+		panic("Invalid graph type: " + spec.Type)
+	}
+}
+
+// Number of nodes in the last layer, these are the
+// last nodes in idx order and depend on the most nodes
+func (spec *Spec) LastLayerSize() int64 {
+	switch spec.Type {
+	case DOUBLE_BUTTERFLY:
+		return Pow2(spec.N)
+	case LINEAR_SUPER_CONCENTRATOR,
+		STACKED_EXPANDERS:
+		return spec.N
+	default:
+		panic("Invalid graph type: " + spec.Type)
+	}
+}
+
+// Number of parents of node idx, false when it
+// depends on the random choices in construction
+// Double butterfly: the first node has none, the rest of
+// the first row have a sequential edge, other nodes add
+// vertical and diagonal edges (for N=1 the diagonal edge
+// can be the sequential edge)
+// Stacked expanders: the first layer has none, each sink
+// has D parents unless the expanders are localized
+func (spec *Spec) InDegree(idx int64) (int64, bool) {
+	switch spec.Type {
+	case DOUBLE_BUTTERFLY:
+		switch {
+		case idx == 0:
+			return 0, true
+		case idx < Pow2(spec.N):
+			return 1, true
+		case spec.N > 1:
+			return 3, true
+		}
+	case STACKED_EXPANDERS:
+		switch {
+		case idx < spec.N:
+			return 0, true
+		case !spec.Localize:
+			return spec.D, true
+		}
+	case LINEAR_SUPER_CONCENTRATOR:
+	default:
+		panic("Invalid graph type: " + spec.Type)
+	}
+	return 0, false
+}
+
+// Whether InDegree is known for every node, parents of
+// localized expanders and superconcentrators are random
+func (spec *Spec) FixedInDegree() bool {
+	switch spec.Type {
+	case DOUBLE_BUTTERFLY:
+		return spec.N > 1
+	case STACKED_EXPANDERS:
+		return !spec.Localize
+	case LINEAR_SUPER_CONCENTRATOR:
+		return false
+	default:
+		panic("Invalid graph type: " + spec.Type)
+	}
+}
+
+func Construct(id int, spec *Spec) *Graph {
+	return ConstructAt(graphPath(id, spec.Type), id, spec)
+}
+
+// Constructs the graph in the leveldb at path
+// instead of the default path for its id and type
+func ConstructAt(path string, id int, spec *Spec) *Graph {
+	switch spec.Type {
+	case DOUBLE_BUTTERFLY:
+		return constructDoubleButterfly(path, id, spec.N, spec.K)
+	case LINEAR_SUPER_CONCENTRATOR:
+		return constructLinearSuperConcentrator(path, id, spec.N, spec.K, spec.D, spec.Localize)
+	case STACKED_EXPANDERS:
+		return constructStackedExpanders(path, id, spec.N, spec.K, spec.D, spec.Localize)
+	default:
+		panic("Invalid graph type: " + spec.Type)
+	}
+}
@@ -15,9 +15,13 @@ func DefaultStackedExpanders(id int) *Graph {
 // Adapted from "Proof of Space from Stacked Expanders", 2016 (Ren, Devadas)
 
 func ConstructStackedExpanders(id int, n, k, d int64, localize bool) *Graph {
+	return constructStackedExpanders(graphPath(id, STACKED_EXPANDERS), id, n, k, d, localize)
+}
+
+func constructStackedExpanders(path string, id int, n, k, d int64, localize bool) *Graph {
 	size := n * (k + 1)
 	stacked := new(StackedExpanders)
-	stacked.Graph = NewGraph(id, size, STACKED_EXPANDERS)
+	stacked.Graph = newGraph(path, id, size, STACKED_EXPANDERS)
 	var nd *Node
 	var idx, m int64
 	// Create nodes
@@ -0,0 +1,254 @@
+package merkle
+
+import (
+	"bytes"
+	. "github.com/zbo14/pos/util"
+)
+
+// Append-only merkle tree
+// Follows the Certificate Transparency construction (RFC 6962):
+// a tree with n leaves splits at the largest power of 2 less than n,
+// so every root for an earlier size can be recomputed and proven
+// consistent with a later one.
+
+const (
+	LEAF_PREFIX byte = 0x00
+	NODE_PREFIX byte = 0x01
+)
+
+var (
+	ErrInvalidIdx  = Error("Invalid idx")
+	ErrInvalidSize = Error("Invalid size")
+)
+
+type Accumulator struct {
+	// levels[k][i] is the hash of the complete subtree
+	// with leaves [i*2^k, (i+1)*2^k)
+	levels [][][]byte
+}
+
+func NewAccumulator() *Accumulator {
+	return &Accumulator{
+		levels: make([][][]byte, 1),
+	}
+}
+
+func LeafHash(value []byte) []byte {
+	hash := NewHash()
+	hash.Write([]byte{LEAF_PREFIX})
+	hash.Write(value)
+	return hash.Sum(nil)
+}
+
+func NodeHash(left, right []byte) []byte {
+	hash := NewHash()
+	hash.Write([]byte{NODE_PREFIX})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+func EmptyRoot() []byte {
+	return NewHash().Sum(nil)
+}
+
+func (acc *Accumulator) Size() int64 {
+	return int64(len(acc.levels[0]))
+}
+
+// Returns idx of the appended leaf
+func (acc *Accumulator) Append(value []byte) int64 {
+	idx := acc.Size()
+	acc.levels[0] = append(acc.levels[0], LeafHash(value))
+	for k := 0; len(acc.levels[k])&1 == 0; k++ {
+		if k+1 == len(acc.levels) {
+			acc.levels = append(acc.levels, nil)
+		}
+		n := len(acc.levels[k])
+		hash := NodeHash(acc.levels[k][n-2], acc.levels[k][n-1])
+		acc.levels[k+1] = append(acc.levels[k+1], hash)
+	}
+	return idx
+}
+
+func (acc *Accumulator) Root() []byte {
+	root, _ := acc.RootAt(acc.Size())
+	return root
+}
+
+// Root of the tree when it had size leaves
+func (acc *Accumulator) RootAt(size int64) ([]byte, error) {
+	if size < 0 || size > acc.Size() {
+		return nil, ErrInvalidSize
+	}
+	if size == 0 {
+		return EmptyRoot(), nil
+	}
+	return acc.subtreeHash(0, size), nil
+}
+
+// Largest power of 2 less than n
+func split(n int64) int64 {
+	k := int64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Hash of leaves [begin, end)
+func (acc *Accumulator) subtreeHash(begin, end int64) []byte {
+	n := end - begin
+	if PowOf2(n) && begin%n == 0 {
+		return acc.levels[Log2(n)][begin/n]
+	}
+	k := split(n)
+	return NodeHash(acc.subtreeHash(begin, begin+k), acc.subtreeHash(begin+k, end))
+}
+
+// Inclusion proof
+
+type InclusionProof struct {
+	Branch [][]byte `json:"branch"`
+	Idx    int64    `json:"idx"`
+	Size   int64    `json:"size"`
+}
+
+func (ip *InclusionProof) String() string {
+	return Sprintf("INCLUSION_PROOF(branch_length=%d,idx=%d,size=%d)", len(ip.Branch), ip.Idx, ip.Size)
+}
+
+// Proves leaf idx is in the tree with size leaves
+func (acc *Accumulator) ProveInclusion(idx, size int64) (*InclusionProof, error) {
+	if size < 1 || size > acc.Size() {
+		return nil, ErrInvalidSize
+	}
+	if idx < 0 || idx >= size {
+		return nil, ErrInvalidIdx
+	}
+	return &InclusionProof{
+		Branch: acc.path(idx, 0, size),
+		Idx:    idx,
+		Size:   size,
+	}, nil
+}
+
+func (acc *Accumulator) path(idx, begin, end int64) [][]byte {
+	n := end - begin
+	if n == 1 {
+		return nil
+	}
+	k := split(n)
+	if idx < k {
+		return append(acc.path(idx, begin, begin+k), acc.subtreeHash(begin+k, end))
+	}
+	return append(acc.path(idx-k, begin+k, end), acc.subtreeHash(begin, begin+k))
+}
+
+func VerifyInclusion(ip *InclusionProof, value, root []byte) bool {
+	if ip.Idx < 0 || ip.Idx >= ip.Size {
+		return false
+	}
+	fn, sn := ip.Idx, ip.Size-1
+	hash := LeafHash(value)
+	for _, otherHash := range ip.Branch {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = NodeHash(otherHash, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = NodeHash(hash, otherHash)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
+
+// Consistency proof
+
+type ConsistencyProof struct {
+	Branch  [][]byte `json:"branch"`
+	NewSize int64    `json:"new_size"`
+	OldSize int64    `json:"old_size"`
+}
+
+func (cp *ConsistencyProof) String() string {
+	return Sprintf("CONSISTENCY_PROOF(branch_length=%d,old_size=%d,new_size=%d)", len(cp.Branch), cp.OldSize, cp.NewSize)
+}
+
+// Proves the tree with oldSize leaves is a prefix
+// of the tree with newSize leaves
+func (acc *Accumulator) ProveConsistency(oldSize, newSize int64) (*ConsistencyProof, error) {
+	if newSize > acc.Size() || oldSize < 1 || oldSize > newSize {
+		return nil, ErrInvalidSize
+	}
+	cp := &ConsistencyProof{
+		NewSize: newSize,
+		OldSize: oldSize,
+	}
+	if oldSize < newSize {
+		cp.Branch = acc.subproof(oldSize, 0, newSize, true)
+	}
+	return cp, nil
+}
+
+func (acc *Accumulator) subproof(m, begin, end int64, complete bool) [][]byte {
+	n := end - begin
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{acc.subtreeHash(begin, end)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(acc.subproof(m, begin, begin+k, complete), acc.subtreeHash(begin+k, end))
+	}
+	return append(acc.subproof(m-k, begin+k, end, false), acc.subtreeHash(begin, begin+k))
+}
+
+func VerifyConsistency(cp *ConsistencyProof, oldRoot, newRoot []byte) bool {
+	if cp.OldSize < 1 || cp.OldSize > cp.NewSize {
+		return false
+	}
+	if cp.OldSize == cp.NewSize {
+		return len(cp.Branch) == 0 && bytes.Equal(oldRoot, newRoot)
+	}
+	branch := cp.Branch
+	if PowOf2(cp.OldSize) {
+		branch = append([][]byte{oldRoot}, branch...)
+	}
+	if len(branch) == 0 {
+		return false
+	}
+	fn, sn := cp.OldSize-1, cp.NewSize-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	oldHash, newHash := branch[0], branch[0]
+	for _, otherHash := range branch[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			oldHash = NodeHash(otherHash, oldHash)
+			newHash = NodeHash(otherHash, newHash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			newHash = NodeHash(newHash, otherHash)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(oldHash, oldRoot) && bytes.Equal(newHash, newRoot)
+}
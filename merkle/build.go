@@ -0,0 +1,140 @@
+package merkle
+
+import (
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb"
+	. "github.com/zbo14/pos/util"
+	"sync"
+)
+
+// Parallel construction of a Tree
+// Each worker hashes a disjoint subtree depth-first and writes
+// its nodes with its own batch. The levels above the subtree
+// roots are then hashed sequentially. The stored nodes are the
+// same as those written by AddLeaf and HashLevels.
+
+// Returns the value of leaf idx
+type LeafFunc func(idx int64) []byte
+
+type builder struct {
+	batch     *leveldb.Batch
+	db        *leveldb.DB
+	err       error
+	leaf      LeafFunc
+	numLeaves int64
+}
+
+func (b *builder) leafValue(idx int64) []byte {
+	if idx >= b.numLeaves {
+		return ZeroLeaf()
+	}
+	return b.leaf(idx)
+}
+
+func (b *builder) put(key int64, value []byte) {
+	b.batch.Put(Int64Bytes(key), value)
+	if b.batch.Len() == int(BATCH_SIZE) {
+		b.flush()
+	}
+}
+
+func (b *builder) flush() {
+	if b.err == nil {
+		b.err = b.db.Write(b.batch, nil)
+	}
+	b.batch = new(leveldb.Batch)
+}
+
+// Hashes node key with leaves [begin, end)
+func (b *builder) hashSubtree(key, begin, end int64) []byte {
+	var value []byte
+	if end-begin == 2 {
+		value = HashPair(b.leafValue(begin), b.leafValue(begin+1))
+	} else {
+		mid := (begin + end) >> 1
+		left := b.hashSubtree(key<<1, begin, mid)
+		right := b.hashSubtree(key<<1+1, mid, end)
+		value = HashPair(left, right)
+	}
+	b.put(key, value)
+	return value
+}
+
+// Initializes the tree and hashes all its nodes
+// with up to workers goroutines
+func (t *Tree) Build(numLeaves int64, leaf LeafFunc, workers int) error {
+	t.Init(numLeaves)
+	numPadded := t.numNodes + 1
+	numSubtrees := int64(1)
+	for numSubtrees<<1 <= int64(workers) && numSubtrees<<2 <= numPadded {
+		numSubtrees <<= 1
+	}
+	subtreeSize := numPadded / numSubtrees
+	builders := make([]*builder, numSubtrees)
+	roots := make([][]byte, numSubtrees)
+	var wg sync.WaitGroup
+	for i := range builders {
+		builders[i] = &builder{
+			batch:     new(leveldb.Batch),
+			db:        t.db,
+			leaf:      leaf,
+			numLeaves: numLeaves,
+		}
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			b := builders[i]
+			roots[i] = b.hashSubtree(numSubtrees+i, i*subtreeSize, (i+1)*subtreeSize)
+			b.flush()
+		}(int64(i))
+	}
+	wg.Wait()
+	for _, b := range builders {
+		if b.err != nil {
+			return b.err
+		}
+	}
+	// Merge subtree roots
+	for level := numSubtrees >> 1; level > 0; level >>= 1 {
+		for i := int64(0); i < level; i++ {
+			roots[i] = HashPair(roots[i<<1], roots[i<<1+1])
+			t.putBatch(level+i, roots[i])
+		}
+	}
+	t.writeBatch()
+	t.leafCount = numLeaves
+	t.nodeCount = 0
+	return t.writeMeta()
+}
+
+func (t *Tree) MustBuild(numLeaves int64, leaf LeafFunc, workers int) {
+	err := t.Build(numLeaves, leaf, workers)
+	Check(err)
+}
+
+// Hashes leaves [begin, end) without writing nodes
+func (b *builder) recompute(begin, end int64) []byte {
+	if end-begin == 2 {
+		return HashPair(b.leafValue(begin), b.leafValue(begin+1))
+	}
+	mid := (begin + end) >> 1
+	return HashPair(b.recompute(begin, mid), b.recompute(mid, end))
+}
+
+// Recomputes the root from the leaves and checks
+// it matches the stored root and metadata
+func (t *Tree) CheckRoot(leaf LeafFunc) error {
+	meta, err := t.Meta()
+	if err != nil {
+		return err
+	}
+	b := &builder{
+		leaf:      leaf,
+		numLeaves: t.numLeaves,
+	}
+	root := b.recompute(0, t.numNodes+1)
+	if !bytes.Equal(root, meta.Root) || !bytes.Equal(root, t.Root()) {
+		return ErrRootMismatch
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package merkle
+
+import (
+	. "github.com/zbo14/pos/util"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache of the levels nearest the root
+// Every proof has a sibling in each level, so these
+// nodes are read on every proof. Caching the top l
+// levels keeps 2^l - 1 nodes in memory.
+
+const MAX_CACHE_LEVELS = 24
+
+var ErrCacheLevels = Error("Cache levels must be in [0, 24]")
+
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func (stats *CacheStats) String() string {
+	return Sprintf("CACHE_STATS(hits=%d,misses=%d,hit_rate=%f)", stats.Hits, stats.Misses, stats.HitRate())
+}
+
+func (stats *CacheStats) HitRate() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+func (stats *CacheStats) Add(other *CacheStats) {
+	stats.Hits += other.Hits
+	stats.Misses += other.Misses
+}
+
+type NodeCache struct {
+	hits   int64
+	misses int64
+	mtx    sync.RWMutex
+	nodes  [][]byte // idx is pos
+}
+
+// Reads nodes [1, min(2^levels, numNodes+1))
+func NewNodeCache(levels int, numNodes int64, read func(pos int64) ([]byte, error)) (*NodeCache, error) {
+	if levels < 0 || levels > MAX_CACHE_LEVELS {
+		return nil, ErrCacheLevels
+	}
+	end := int64(1) << uint(levels)
+	if end > numNodes+1 {
+		end = numNodes + 1
+	}
+	if end < 1 {
+		end = 1
+	}
+	nodes := make([][]byte, end)
+	for pos := int64(1); pos < end; pos++ {
+		value, err := read(pos)
+		if err != nil {
+			return nil, err
+		}
+		nodes[pos] = value
+	}
+	return &NodeCache{nodes: nodes}, nil
+}
+
+// A nil cache has no nodes and counts nothing
+func (c *NodeCache) Get(pos int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if pos > 0 && pos < int64(len(c.nodes)) {
+		atomic.AddInt64(&c.hits, 1)
+		return c.nodes[pos], true
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil, false
+}
+
+// Called when a node is rewritten
+func (c *NodeCache) Update(pos int64, value []byte) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if pos > 0 && pos < int64(len(c.nodes)) {
+		c.nodes[pos] = value
+	}
+}
+
+func (c *NodeCache) Stats() *CacheStats {
+	if c == nil {
+		return new(CacheStats)
+	}
+	return &CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// Cache the top levels of the tree
+// The cache is dropped when the tree is initialized
+func (t *Tree) CacheLevels(levels int) error {
+	cache, err := NewNodeCache(levels, t.numNodes, t.node)
+	if err != nil {
+		return err
+	}
+	t.cache = cache
+	return nil
+}
+
+func (t *Tree) CacheStats() *CacheStats {
+	return t.cache.Stats()
+}
+
+func (t *Tree) node(pos int64) ([]byte, error) {
+	return t.db.Get(Int64Bytes(pos), nil)
+}
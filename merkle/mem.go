@@ -2,12 +2,24 @@ package merkle
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	. "github.com/zbo14/pos/util"
 	"golang.org/x/crypto/ripemd160"
 )
 
 // Simple merkle tree in memory
 
+const MAX_BRANCH_LENGTH = 64
+
+var (
+	ErrLeafNoValue       = Error("Leaf does not have value")
+	ErrMemTreeNotEmpty   = Error("MemTree is not empty")
+	ErrNoValues          = Error("No values")
+	ErrInvalidBranch     = Error("Invalid branch")
+	ErrInvalidHashLength = Error("Invalid hash length")
+)
+
 // TODO: add String() methods
 
 type Node struct {
@@ -61,35 +73,151 @@ func (t *MemTree) Level(height int) Level {
 	return t.levels[height]
 }
 
+// A nil hash in the branch means the node has no sibling
+
 type MemProof struct {
-	branch Branch
-	hash   []byte
-	idx    int
+	Branch Branch `json:"branch"`
+	Hash   []byte `json:"hash"`
+	Idx    int    `json:"idx"`
 }
 
-func NewMemProof(branch Branch, hash []byte) *MemProof {
+func NewMemProof(branch Branch, hash []byte, idx int) *MemProof {
 	return &MemProof{
-		branch: branch,
-		hash:   hash,
+		Branch: branch,
+		Hash:   hash,
+		Idx:    idx,
+	}
+}
+
+func (memProof *MemProof) String() string {
+	return Sprintf("MEM_PROOF(branch_length=%d,hash=%x,idx=%d)", len(memProof.Branch), memProof.Hash, memProof.Idx)
+}
+
+func (memProof *MemProof) Validate() error {
+	if size := len(memProof.Hash); size != ripemd160.Size {
+		return ErrInvalidHashLength
+	}
+	length := len(memProof.Branch)
+	if length == 0 || length > MAX_BRANCH_LENGTH {
+		return ErrInvalidBranch
+	}
+	if memProof.Idx < 0 || memProof.Idx>>uint(length) != 0 {
+		return ErrInvalidIdx
+	}
+	for _, hash := range memProof.Branch {
+		if size := len(hash); size != 0 && size != ripemd160.Size {
+			return ErrInvalidHashLength
+		}
+	}
+	return nil
+}
+
+// Binary encoding, integers are big endian:
+// idx (8 bytes), hash, branch length (8 bytes),
+// then for each branch hash: 1 if set else 0, hash (if set)
+
+func (memProof *MemProof) MarshalBinary() ([]byte, error) {
+	if err := memProof.Validate(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 16+ripemd160.Size, 16+ripemd160.Size*(len(memProof.Branch)+2))
+	binary.BigEndian.PutUint64(data[:8], uint64(memProof.Idx))
+	copy(data[8:8+ripemd160.Size], memProof.Hash)
+	binary.BigEndian.PutUint64(data[8+ripemd160.Size:], uint64(len(memProof.Branch)))
+	for _, hash := range memProof.Branch {
+		if len(hash) == 0 {
+			data = append(data, 0)
+		} else {
+			data = append(data, 1)
+			data = append(data, hash...)
+		}
 	}
+	return data, nil
 }
 
-func (t *MemTree) ComputeMemProof(idx int) *MemProof {
-	if idx < 0 {
-		panic("Idx cannot be less than 0")
+func (memProof *MemProof) UnmarshalBinary(data []byte) error {
+	if len(data) < 16+ripemd160.Size {
+		return ErrInvalidBranch
+	}
+	idx := binary.BigEndian.Uint64(data[:8])
+	if int64(idx) < 0 {
+		return ErrInvalidIdx
+	}
+	n := 8
+	hash := make([]byte, ripemd160.Size)
+	copy(hash, data[n:n+ripemd160.Size])
+	n += ripemd160.Size
+	length := binary.BigEndian.Uint64(data[n : n+8])
+	n += 8
+	if length < 1 || length > MAX_BRANCH_LENGTH {
+		return ErrInvalidBranch
+	}
+	branch := make(Branch, length)
+	for i := range branch {
+		if n == len(data) {
+			return ErrInvalidBranch
+		}
+		switch data[n] {
+		case 0:
+			n++
+		case 1:
+			n++
+			if n+ripemd160.Size > len(data) {
+				return ErrInvalidHashLength
+			}
+			branch[i] = make([]byte, ripemd160.Size)
+			copy(branch[i], data[n:n+ripemd160.Size])
+			n += ripemd160.Size
+		default:
+			return ErrInvalidBranch
+		}
+	}
+	if n != len(data) {
+		return ErrProofSize
+	}
+	memProof.Branch = branch
+	memProof.Hash = hash
+	memProof.Idx = int(idx)
+	return memProof.Validate()
+}
+
+type memProofJSON MemProof
+
+func (memProof *MemProof) MarshalJSON() ([]byte, error) {
+	if err := memProof.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal((*memProofJSON)(memProof))
+}
+
+func (memProof *MemProof) UnmarshalJSON(data []byte) error {
+	var mp memProofJSON
+	if err := json.Unmarshal(data, &mp); err != nil {
+		return err
+	}
+	if err := (*MemProof)(&mp).Validate(); err != nil {
+		return err
+	}
+	*memProof = MemProof(mp)
+	return nil
+}
+
+func (t *MemTree) ComputeMemProof(idx int) (*MemProof, error) {
+	if t.Empty() {
+		return nil, ErrNoValues
 	}
 	height := t.Height()
 	leaves := t.Level(height)
-	if length := len(leaves); idx >= length {
-		Panicf("Expected idx <= %d; got idx=%d\n", length, idx)
+	if idx < 0 || idx >= len(leaves) {
+		return nil, ErrInvalidIdx
 	}
 	memProof := new(MemProof)
-	memProof.idx = idx
-	memProof.hash = leaves[idx].hash
+	memProof.Idx = idx
+	memProof.Hash = leaves[idx].hash
 	if idx^1 < len(leaves) {
-		memProof.branch = append(memProof.branch, leaves[idx^1].hash)
+		memProof.Branch = append(memProof.Branch, leaves[idx^1].hash)
 	} else {
-		memProof.branch = append(memProof.branch, nil)
+		memProof.Branch = append(memProof.Branch, nil)
 	}
 	for {
 		height--
@@ -99,32 +227,35 @@ func (t *MemTree) ComputeMemProof(idx int) *MemProof {
 			break
 		}
 		if idx >>= 1; idx^1 < len(level) {
-			memProof.branch = append(memProof.branch, level[idx^1].hash)
+			memProof.Branch = append(memProof.Branch, level[idx^1].hash)
 		} else {
-			memProof.branch = append(memProof.branch, nil)
+			memProof.Branch = append(memProof.Branch, nil)
 		}
 
 	}
-	return memProof
+	return memProof, nil
 }
 
 func VerifyMemProof(memProof *MemProof, root []byte) bool {
-	branch := memProof.branch
-	hash := memProof.hash
+	if memProof == nil || memProof.Validate() != nil {
+		return false
+	}
+	hash := memProof.Hash
 	hasher := ripemd160.New()
-	idx := memProof.idx
-	for _, otherHash := range branch {
-		if otherHash != nil {
+	idx := memProof.Idx
+	for _, otherHash := range memProof.Branch {
+		if len(otherHash) != 0 {
 			if idx&1 == 0 {
-				hash = append(hash, otherHash...)
+				hasher.Write(hash)
+				hasher.Write(otherHash)
 			} else {
-				hash = append(otherHash, hash...)
+				hasher.Write(otherHash)
+				hasher.Write(hash)
 			}
 		} else {
-			// just hash the previous hash
-			// should this happen?
+			// node has no sibling.. just hash the previous hash
+			hasher.Write(hash)
 		}
-		hasher.Write(hash)
 		hash = hasher.Sum(nil)
 		hasher.Reset()
 		idx >>= 1
@@ -133,30 +264,32 @@ func VerifyMemProof(memProof *MemProof, root []byte) bool {
 	return match
 }
 
+func MemLeafHash(value []byte) []byte {
+	hasher := ripemd160.New()
+	hasher.Write(value)
+	return hasher.Sum(nil)
+}
+
 // (1) Calculates height of tree, creates that many levels
 // (2) Sets values for leaf nodes
 // (3) Establishes parent-child relationships between levels
 
-func (t *MemTree) Construct(values [][]byte) {
+func (t *MemTree) Construct(values [][]byte) error {
 	if !t.Empty() {
 		// MemTree should be empty
-		panic("MemTree is not empty")
+		return ErrMemTreeNotEmpty
 	}
 	var count int
 	if count = len(values); count == 0 {
-		panic("No values")
+		return ErrNoValues
 	}
 	height := calcMemTreeHeight(count)
 	t.levels = make([]Level, height)
 	height--
 	t.levels[height] = make(Level, count)
-	hasher := ripemd160.New()
 	Printf("There are %d leaves\n", len(values))
 	for i, value := range values {
-		hasher.Write(value)
-		hash := hasher.Sum(nil)
-		t.levels[height][i] = &Node{hash: hash}
-		hasher.Reset()
+		t.levels[height][i] = &Node{hash: MemLeafHash(value)}
 	}
 	for height > 0 {
 		children := t.levels[height]
@@ -164,6 +297,7 @@ func (t *MemTree) Construct(values [][]byte) {
 		t.levels[height] = constructLevel(children)
 		Printf("Level %d has %d nodes\n", height, len(t.levels[height]))
 	}
+	return nil
 }
 
 func constructLevel(children Level) Level {
@@ -210,7 +344,10 @@ func calcMemTreeHeight(count int) int {
 
 // DFS traversal and hashing of non-leaf nodes
 
-func (t *MemTree) HashLevels() []byte {
+func (t *MemTree) HashLevels() ([]byte, error) {
+	if t.Empty() {
+		return nil, ErrNoValues
+	}
 	root := t.Root()
 	nd := root
 	var hash []byte
@@ -218,13 +355,13 @@ func (t *MemTree) HashLevels() []byte {
 	for {
 		if nd.hash != nil {
 			if nd == root {
-				return nd.hash
+				return nd.hash, nil
 			}
 			nd = nd.parent
 			continue
 		}
 		if nd.IsLeaf() {
-			panic("Leaf does not have value")
+			return nil, ErrLeafNoValue
 		}
 		if nd.left.hash == nil {
 			nd = nd.left
@@ -242,7 +379,7 @@ func (t *MemTree) HashLevels() []byte {
 		nd.hash = hasher.Sum(nil)
 		hasher.Reset()
 		if nd == root {
-			return nd.hash
+			return nd.hash, nil
 		}
 		nd = nd.parent
 	}
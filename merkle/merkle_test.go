@@ -1,9 +1,19 @@
 package merkle
 
 import (
+	"bytes"
+	. "github.com/zbo14/pos/util"
+	"os"
+	"reflect"
+	"runtime"
 	"testing"
 )
 
+const (
+	MAX_LEAVES = 1025
+	TREE_ID    = 0
+)
+
 var values = [][]byte{
 	[]byte("abc"),
 	[]byte("xyz"),
@@ -33,3 +43,414 @@ func TestMerkle(t *testing.T) {
 		t.Error("MemProof verification failed")
 	}
 }
+
+func TestMemProofCodec(t *testing.T) {
+	tree := new(MemTree)
+	if err := tree.Construct(values); err != nil {
+		t.Fatal(err.Error())
+	}
+	rootHash, err := tree.HashLevels()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx := range values {
+		proof, err := tree.ComputeMemProof(idx)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, err := proof.MarshalBinary()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		binProof := new(MemProof)
+		if err = binProof.UnmarshalBinary(data); err != nil {
+			t.Fatal(err.Error())
+		}
+		if !VerifyMemProof(binProof, rootHash) {
+			t.Errorf("Binary decoded MemProof verification failed for idx=%d", idx)
+		}
+		if err = binProof.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Errorf("Expected error for truncated MemProof with idx=%d", idx)
+		}
+		if err = binProof.UnmarshalBinary(append(data, 0)); err == nil {
+			t.Errorf("Expected error for MemProof with extra bytes with idx=%d", idx)
+		}
+		jsonProof := new(MemProof)
+		UnmarshalJSON(MarshalJSON(proof), jsonProof)
+		if !VerifyMemProof(jsonProof, rootHash) {
+			t.Errorf("JSON decoded MemProof verification failed for idx=%d", idx)
+		}
+	}
+	proof, _ := tree.ComputeMemProof(0)
+	proof.Hash = proof.Hash[1:]
+	if _, err = proof.MarshalBinary(); err != ErrInvalidHashLength {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidHashLength, err)
+	}
+	// Malformed binary encodings
+	proof, _ = tree.ComputeMemProof(0)
+	data, err := proof.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, malformed := range [][]byte{
+		nil,
+		data[:8],
+		append([]byte{0x80}, data[1:]...), // idx out of range
+		append(append(append([]byte{}, data[:28]...), 0xff), data[29:]...), // branch length out of range
+		append(append(append([]byte{}, data[:36]...), 2), data[37:]...),    // invalid hash flag
+		append(data, 1),
+	} {
+		if err = new(MemProof).UnmarshalBinary(malformed); err == nil {
+			t.Errorf("Expected error for malformed MemProof %x", malformed)
+		}
+	}
+	data = []byte(`{"branch":["AAAA"],"hash":null,"idx":0}`)
+	if err = new(MemProof).UnmarshalJSON(data); err == nil {
+		t.Error("Expected error for JSON MemProof with invalid lengths")
+	}
+}
+
+func leafValues(numLeaves int64) [][]byte {
+	leaves := make([][]byte, numLeaves)
+	for i := range leaves {
+		leaves[i] = Sum32(Int64Bytes(int64(i)))
+	}
+	return leaves
+}
+
+func TestTree(t *testing.T) {
+	defer os.RemoveAll("tree")
+	tree := NewTree(TREE_ID)
+	maxLeaves := int64(MAX_LEAVES)
+	if testing.Short() {
+		maxLeaves = 65
+	}
+	var numLeaves int64
+	for numLeaves = 1; numLeaves <= maxLeaves; numLeaves++ {
+		tree.Init(numLeaves)
+		leaves := leafValues(numLeaves)
+		for _, leaf := range leaves {
+			if !tree.AddLeaf(leaf) {
+				t.Fatalf("Could not add leaf to tree with %d leaves", numLeaves)
+			}
+		}
+		if tree.AddLeaf(leaves[0]) {
+			t.Fatalf("Added too many leaves to tree with %d leaves", numLeaves)
+		}
+		if err := tree.HashLevels(); err != nil {
+			t.Fatal(err.Error())
+		}
+		root := tree.Root()
+		for idx, leaf := range leaves {
+			var sibling []byte
+			if idx^1 < len(leaves) {
+				sibling = leaves[idx^1]
+			}
+			proof := tree.ComputeProof(int64(idx), sibling, leaf)
+			if !VerifyProof(proof, root) {
+				t.Fatalf("Proof verification failed for idx=%d in tree with %d leaves", idx, numLeaves)
+			}
+			proof.Value = leaves[(idx+1)%len(leaves)]
+			if numLeaves > 1 && VerifyProof(proof, root) {
+				t.Fatalf("Verified proof with wrong value for idx=%d in tree with %d leaves", idx, numLeaves)
+			}
+		}
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	defer os.RemoveAll("tree")
+	numLeaves := int64(37)
+	expected := testProofs(numLeaves)
+	tree, err := OpenTree(TreePath(TREE_ID))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tree.Close()
+	if err = tree.CacheLevels(MAX_CACHE_LEVELS + 1); err != ErrCacheLevels {
+		t.Fatalf("Expected err=%v; got err=%v", ErrCacheLevels, err)
+	}
+	// 64 padded leaves, a branch has 6 siblings and
+	// the top 3 levels hold the 2 siblings below the root
+	if err = tree.CacheLevels(3); err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx, p := range expected {
+		proof := tree.ComputeProof(int64(idx), p.Branch[0], p.Value)
+		if !reflect.DeepEqual(proof, p) {
+			t.Fatalf("Expected %v; got %v", p, proof)
+		}
+	}
+	stats := tree.CacheStats()
+	if stats.Hits != 2*numLeaves || stats.Misses != 3*numLeaves {
+		t.Errorf("Expected hits=%d, misses=%d; got %v", 2*numLeaves, 3*numLeaves, stats)
+	}
+	if rate := stats.HitRate(); rate != 0.4 {
+		t.Errorf("Expected hit rate=0.4; got rate=%f", rate)
+	}
+	// Cache is dropped when the tree is rebuilt
+	tree.MustBuild(numLeaves, leafFunc, 1)
+	if stats = tree.CacheStats(); stats.Hits != 0 {
+		t.Errorf("Expected empty stats; got %v", stats)
+	}
+}
+
+func testProofs(numLeaves int64) []*Proof {
+	tree := NewTree(TREE_ID)
+	leaves := leafValues(numLeaves)
+	tree.MustBuild(numLeaves, leafFunc, 1)
+	proofs := make([]*Proof, numLeaves)
+	for idx, leaf := range leaves {
+		var sibling []byte
+		if idx^1 < len(leaves) {
+			sibling = leaves[idx^1]
+		}
+		proofs[idx] = tree.ComputeProof(int64(idx), sibling, leaf)
+	}
+	tree.Close()
+	return proofs
+}
+
+func TestProofCodec(t *testing.T) {
+	defer os.RemoveAll("tree")
+	proofs := testProofs(11)
+	proof := proofs[5]
+	data, err := proof.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data) > MAX_PROOF_SIZE {
+		t.Fatalf("Expected size <= %d; got size=%d", MAX_PROOF_SIZE, len(data))
+	}
+	decoded := new(Proof)
+	if err = decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if decoded.Idx != proof.Idx || decoded.Pos != proof.Pos || !bytes.Equal(decoded.Value, proof.Value) {
+		t.Fatalf("Expected %v; got %v", proof, decoded)
+	}
+	// Truncated and trailing bytes
+	if err = decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Expected error for truncated proof")
+	}
+	if err = decoded.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Error("Expected error for proof with trailing bytes")
+	}
+	// Idx must be in range of the branch
+	data[7] = 16
+	if err = decoded.UnmarshalBinary(data); err != ErrInvalidIdx {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidIdx, err)
+	}
+	// Pos must match idx
+	proof.Pos = proofs[4].Pos
+	if VerifyProof(proof, nil) {
+		t.Error("Verified proof with wrong pos")
+	}
+	if _, err = proof.MarshalBinary(); err != ErrInvalidPos {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidPos, err)
+	}
+}
+
+func FuzzProof(f *testing.F) {
+	defer os.RemoveAll("tree")
+	for _, proof := range testProofs(5) {
+		data, _ := proof.MarshalBinary()
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		proof := new(Proof)
+		if err := proof.UnmarshalBinary(data); err != nil {
+			return
+		}
+		if len(data) > MAX_PROOF_SIZE {
+			t.Fatalf("Decoded proof with size=%d", len(data))
+		}
+		encoded, err := proof.MarshalBinary()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatal("Encoding is not canonical")
+		}
+	})
+}
+
+func TestTreeMissingLeaves(t *testing.T) {
+	defer os.RemoveAll("tree")
+	tree := NewTree(TREE_ID)
+	tree.Init(5)
+	for _, leaf := range leafValues(4) {
+		tree.AddLeaf(leaf)
+	}
+	if err := tree.HashLevels(); err != ErrMissingLeaves {
+		t.Errorf("Expected err=%v; got err=%v", ErrMissingLeaves, err)
+	}
+}
+
+func TestAccumulator(t *testing.T) {
+	acc := NewAccumulator()
+	leaves := leafValues(MAX_LEAVES >> 4)
+	roots := [][]byte{acc.Root()}
+	for i, leaf := range leaves {
+		if idx := acc.Append(leaf); idx != int64(i) {
+			t.Fatalf("Expected idx=%d; got idx=%d", i, idx)
+		}
+		roots = append(roots, acc.Root())
+	}
+	for size := int64(1); size <= acc.Size(); size++ {
+		root, err := acc.RootAt(size)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(root, roots[size]) {
+			t.Fatalf("Historical root for size=%d does not match", size)
+		}
+		for idx := int64(0); idx < size; idx++ {
+			proof, err := acc.ProveInclusion(idx, size)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !VerifyInclusion(proof, leaves[idx], root) {
+				t.Fatalf("Inclusion proof verification failed for idx=%d, size=%d", idx, size)
+			}
+			if VerifyInclusion(proof, leaves[(idx+1)%size], root) && size > 1 {
+				t.Fatalf("Verified inclusion proof with wrong value for idx=%d, size=%d", idx, size)
+			}
+		}
+		for oldSize := int64(1); oldSize <= size; oldSize++ {
+			proof, err := acc.ProveConsistency(oldSize, size)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !VerifyConsistency(proof, roots[oldSize], root) {
+				t.Fatalf("Consistency proof verification failed for old_size=%d, new_size=%d", oldSize, size)
+			}
+			if oldSize > 1 && VerifyConsistency(proof, roots[oldSize-1], root) {
+				t.Fatalf("Verified consistency proof with wrong root for old_size=%d, new_size=%d", oldSize, size)
+			}
+		}
+	}
+	if _, err := acc.ProveInclusion(acc.Size(), acc.Size()); err != ErrInvalidIdx {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidIdx, err)
+	}
+	if _, err := acc.ProveConsistency(1, acc.Size()+1); err != ErrInvalidSize {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidSize, err)
+	}
+}
+
+func leafFunc(idx int64) []byte {
+	return Sum32(Int64Bytes(idx))
+}
+
+func TestBuild(t *testing.T) {
+	defer os.RemoveAll("tree")
+	sequential := NewTree(TREE_ID)
+	parallel := NewTree(TREE_ID + 1)
+	maxLeaves := int64(MAX_LEAVES >> 2)
+	if testing.Short() {
+		maxLeaves = 65
+	}
+	var numLeaves int64
+	for numLeaves = 1; numLeaves <= maxLeaves; numLeaves++ {
+		sequential.Init(numLeaves)
+		for _, leaf := range leafValues(numLeaves) {
+			sequential.AddLeaf(leaf)
+		}
+		if err := sequential.HashLevels(); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, workers := range []int{1, 3, 8} {
+			if err := parallel.Build(numLeaves, leafFunc, workers); err != nil {
+				t.Fatal(err.Error())
+			}
+			for key := int64(1); key <= sequential.numNodes; key++ {
+				expected, err := sequential.db.Get(Int64Bytes(key), nil)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				value, err := parallel.db.Get(Int64Bytes(key), nil)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !bytes.Equal(expected, value) {
+					t.Fatalf("Node %d differs for %d leaves with %d workers", key, numLeaves, workers)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkTree(b *testing.B, build func(tree *Tree, numLeaves int64)) {
+	defer os.RemoveAll("tree")
+	tree := NewTree(TREE_ID)
+	for _, log := range []int64{16, 20, 24} {
+		numLeaves := Pow2(log)
+		b.Run(Sprintf("2^%d", log), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				build(tree, numLeaves)
+			}
+		})
+	}
+}
+
+func BenchmarkTreeSequential(b *testing.B) {
+	benchmarkTree(b, func(tree *Tree, numLeaves int64) {
+		tree.Init(numLeaves)
+		for idx := int64(0); idx < numLeaves; idx++ {
+			tree.AddLeaf(leafFunc(idx))
+		}
+		tree.MustHashLevels()
+	})
+}
+
+func BenchmarkTreeParallel(b *testing.B) {
+	benchmarkTree(b, func(tree *Tree, numLeaves int64) {
+		tree.MustBuild(numLeaves, leafFunc, runtime.NumCPU())
+	})
+}
+
+func TestOpenTree(t *testing.T) {
+	defer os.RemoveAll("tree")
+	var numLeaves int64 = 37
+	tree := NewTree(TREE_ID)
+	tree.MustBuild(numLeaves, leafFunc, 4)
+	root := tree.Root()
+	if err := tree.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	tree, err := OpenTree(TreePath(TREE_ID))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := tree.NumLeaves(); n != numLeaves {
+		t.Fatalf("Expected %d leaves; got %d", numLeaves, n)
+	}
+	if !bytes.Equal(root, tree.Root()) {
+		t.Fatal("Reopened tree has different root")
+	}
+	for idx := int64(0); idx < numLeaves; idx++ {
+		var sibling []byte
+		if idx^1 < numLeaves {
+			sibling = leafFunc(idx ^ 1)
+		}
+		proof := tree.ComputeProof(idx, sibling, leafFunc(idx))
+		if !VerifyProof(proof, root) {
+			t.Fatalf("Proof verification failed for idx=%d", idx)
+		}
+	}
+	if err = tree.CheckRoot(leafFunc); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = tree.CheckRoot(func(idx int64) []byte { return leafFunc(idx + 1) }); err != ErrRootMismatch {
+		t.Errorf("Expected err=%v; got err=%v", ErrRootMismatch, err)
+	}
+	// Unfinished trees cannot be reopened
+	tree.Init(numLeaves)
+	tree.Close()
+	if _, err = OpenTree(TreePath(TREE_ID)); err != ErrTreeNotFinished {
+		t.Errorf("Expected err=%v; got err=%v", ErrTreeNotFinished, err)
+	}
+	if _, err = OpenTree(TreePath(TREE_ID + 1)); err == nil {
+		t.Error("Expected error opening missing tree")
+	}
+}
@@ -2,7 +2,9 @@ package merkle
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	. "github.com/zbo14/pos/util"
 	"path/filepath"
 	"strconv"
@@ -14,6 +16,7 @@ import (
 
 type Tree struct {
 	batch     *leveldb.Batch
+	cache     *NodeCache
 	db        *leveldb.DB
 	leafCount int64
 	nodeCount int64
@@ -26,20 +29,139 @@ func (t *Tree) String() string {
 	return Sprintf("TREE(num_leaves=%d,num_nodes=%d,value=%x)", t.numLeaves, t.numNodes, t.value)
 }
 
+func TreePath(treeId int) string {
+	return filepath.Join("tree", strconv.Itoa(treeId))
+}
+
 func NewTree(treeId int) *Tree {
 	var err error
 	t := new(Tree)
 	t.batch = new(leveldb.Batch)
-	treePath := filepath.Join("tree", strconv.Itoa(treeId))
-	t.db, err = leveldb.OpenFile(treePath, nil)
+	t.db, err = leveldb.OpenFile(TreePath(treeId), nil)
 	Check(err)
 	return t
 }
 
+// Metadata is written once all the nodes are hashed,
+// so a tree can be reopened and proven without a rebuild
+
+const TREE_VERSION = 1
+
+var (
+	ErrRootMismatch    = Error("Stored root does not match recomputed root")
+	ErrTreeHash        = Error("Tree has unexpected hash function")
+	ErrTreeNotFinished = Error("Tree does not have metadata")
+	ErrTreeVersion     = Error("Tree has unexpected format version")
+)
+
+var metaKey = []byte("meta")
+
+type TreeMeta struct {
+	Hash      string `json:"hash"`
+	NumLeaves int64  `json:"num_leaves"`
+	Root      []byte `json:"root"`
+	Version   int    `json:"version"`
+}
+
+func HashName() string {
+	return Sprintf("sha3-%d", HASH_SIZE*8)
+}
+
+func (t *Tree) writeMeta() error {
+	root, err := t.db.Get(Int64Bytes(1), nil)
+	if err != nil {
+		return err
+	}
+	meta := &TreeMeta{
+		Hash:      HashName(),
+		NumLeaves: t.numLeaves,
+		Root:      root,
+		Version:   TREE_VERSION,
+	}
+	return t.db.Put(metaKey, MarshalJSON(meta), nil)
+}
+
+func (t *Tree) Meta() (*TreeMeta, error) {
+	data, err := t.db.Get(metaKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrTreeNotFinished
+	} else if err != nil {
+		return nil, err
+	}
+	meta := new(TreeMeta)
+	if err = ReadJSON(bytes.NewReader(data), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Opens a finished tree so it is ready to prove
+func OpenTree(treePath string) (*Tree, error) {
+	db, err := leveldb.OpenFile(treePath, &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{
+		batch: new(leveldb.Batch),
+		db:    db,
+	}
+	meta, err := t.Meta()
+	if err == nil {
+		switch {
+		case meta.Version != TREE_VERSION:
+			err = ErrTreeVersion
+		case meta.Hash != HashName():
+			err = ErrTreeHash
+		case meta.NumLeaves < 1:
+			err = ErrTreeNotFinished
+		case !bytes.Equal(meta.Root, t.Root()):
+			err = ErrRootMismatch
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	t.setNumLeaves(meta.NumLeaves)
+	t.leafCount = meta.NumLeaves
+	return t, nil
+}
+
+func (t *Tree) Close() error {
+	return t.db.Close()
+}
+
+// Leaves are padded to the next power of 2 (at least 2)
+// with zero-valued leaves. Padding nodes are hashed like
+// any other node, so every leaf has a full-length branch.
+
+var ErrMissingLeaves = Error("Tree does not have all its leaves")
+
 func (t *Tree) Init(numLeaves int64) {
+	if numLeaves < 1 {
+		panic("Tree must have at least 1 leaf")
+	}
+	err := t.db.Delete(metaKey, nil)
+	Check(err)
+	t.batch = new(leveldb.Batch)
+	t.cache = nil
+	t.leafCount = 0
+	t.setNumLeaves(numLeaves)
+	t.nodeCount = (t.numNodes + 1) >> 1
+	t.value = nil
+}
+
+func (t *Tree) setNumLeaves(numLeaves int64) {
+	numPadded := GetPowOf2(numLeaves)
+	if numPadded < 2 {
+		numPadded = 2
+	}
 	t.numLeaves = numLeaves
-	t.numNodes = GetPowOf2(numLeaves) - 1
-	t.nodeCount = t.numNodes>>1 + 1
+	t.numNodes = numPadded - 1
+}
+
+func (t *Tree) NumLeaves() int64 {
+	return t.numLeaves
 }
 
 func (t *Tree) Root() []byte {
@@ -49,6 +171,31 @@ func (t *Tree) Root() []byte {
 	return value
 }
 
+// Value of a padding leaf
+func ZeroLeaf() []byte {
+	return make([]byte, HASH_SIZE)
+}
+
+func HashPair(left, right []byte) []byte {
+	hash := NewHash()
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+func (t *Tree) putBatch(key int64, value []byte) {
+	t.batch.Put(Int64Bytes(key), value)
+	if t.batch.Len() == int(BATCH_SIZE) {
+		t.writeBatch()
+	}
+}
+
+func (t *Tree) writeBatch() {
+	err := t.db.Write(t.batch, nil)
+	Check(err)
+	t.batch = new(leveldb.Batch)
+}
+
 // 1) Add leaves, set hashes of top-level nodes
 // We are assuming the values are topologically sorted
 func (t *Tree) AddLeaf(value []byte) bool {
@@ -58,66 +205,55 @@ func (t *Tree) AddLeaf(value []byte) bool {
 	if t.leafCount&1 == 0 {
 		t.value = value
 	} else {
-		t.value = append(t.value, value...)
-		hash := NewHash()
-		hash.Write(t.value)
-		key, value := Int64Bytes(t.nodeCount), hash.Sum(nil)
-		t.batch.Put(key, value)
+		t.putBatch(t.nodeCount, HashPair(t.value, value))
 		t.value = nil
 		t.nodeCount++
-		if t.leafCount%BATCH_SIZE == 0 || t.leafCount+1 == t.numLeaves {
-			err := t.db.Write(t.batch, nil)
-			Check(err)
-			t.batch = new(leveldb.Batch)
-		}
 	}
 	t.leafCount++
 	return true
 }
 
-// 2) Hash lower-level nodes
-func (t *Tree) HashLevels() {
+// 2) Hash padding and lower-level nodes
+func (t *Tree) HashLevels() error {
 	if t.leafCount != t.numLeaves {
-		// tree does not have all its leaves
-		// return err?
+		return ErrMissingLeaves
 	}
-	count := 0
-	var key, value []byte
-	hash := NewHash()
-	for t.nodeCount > 0 {
-		if t.nodeCount > t.numNodes {
-			t.nodeCount = t.numNodes >> 1
+	zero := ZeroLeaf()
+	if t.value != nil {
+		// last leaf is paired with padding
+		t.putBatch(t.nodeCount, HashPair(t.value, zero))
+		t.value = nil
+		t.nodeCount++
+	}
+	if t.nodeCount <= t.numNodes {
+		// remaining top-level nodes only have padding
+		zero = HashPair(zero, zero)
+		for ; t.nodeCount <= t.numNodes; t.nodeCount++ {
+			t.putBatch(t.nodeCount, zero)
 		}
-		if t.nodeCount > t.numNodes>>1 {
-			count++
-			if t.value == nil {
-				// empty node
-				key, value = Int64Bytes(t.nodeCount), t.value
-			} else {
-				// we have top-level node with one child
-				hash.Reset()
-				hash.Write(t.value)
-				key, value = Int64Bytes(t.nodeCount), hash.Sum(nil)
-				t.value = nil
-			}
-			t.nodeCount++
-		} else {
-			times2 := t.nodeCount << 1
-			keyLeft := Int64Bytes(times2)
-			valueLeft, err := t.db.Get(keyLeft, nil)
-			Check(err)
-			keyRight := Int64Bytes(times2 + 1)
-			valueRight, err := t.db.Get(keyRight, nil)
-			Check(err)
-			t.value = append(valueLeft, valueRight...)
-			hash.Reset()
-			hash.Write(t.value)
-			key, value = Int64Bytes(t.nodeCount), hash.Sum(nil)
-			t.nodeCount--
+	}
+	t.writeBatch()
+	for t.nodeCount = t.numNodes >> 1; t.nodeCount > 0; t.nodeCount-- {
+		times2 := t.nodeCount << 1
+		valueLeft, err := t.db.Get(Int64Bytes(times2), nil)
+		if err != nil {
+			return err
+		}
+		valueRight, err := t.db.Get(Int64Bytes(times2+1), nil)
+		if err != nil {
+			return err
+		}
+		key, value := Int64Bytes(t.nodeCount), HashPair(valueLeft, valueRight)
+		if err = t.db.Put(key, value, nil); err != nil {
+			return err
 		}
-		err := t.db.Put(key, value, nil)
-		Check(err)
 	}
+	return t.writeMeta()
+}
+
+func (t *Tree) MustHashLevels() {
+	err := t.HashLevels()
+	Check(err)
 }
 
 type Proof struct {
@@ -132,7 +268,114 @@ func (mp *Proof) String() string {
 		len(mp.Branch), mp.Idx, mp.Pos, mp.Value[:3])
 }
 
+// A tree has at most 2^MAX_TREE_HEIGHT leaves (after padding),
+// so a proof is at most MAX_PROOF_SIZE bytes
+
+const (
+	MAX_TREE_HEIGHT = 40
+	MAX_PROOF_SIZE  = 9 + HASH_SIZE*(MAX_TREE_HEIGHT+1)
+)
+
+var (
+	ErrInvalidPos   = Error("Proof pos does not match idx")
+	ErrInvalidValue = Error("Proof has invalid value")
+	ErrProofSize    = Error("Proof has invalid size")
+)
+
+// The branch has one hash per level, so the leaf
+// is at pos = idx + 2^(branch length)
+func (mp *Proof) Validate() error {
+	length := len(mp.Branch)
+	if length < 1 || length > MAX_TREE_HEIGHT {
+		return ErrInvalidBranch
+	}
+	if mp.Idx < 0 || mp.Idx>>uint(length) != 0 {
+		return ErrInvalidIdx
+	}
+	if mp.Pos != mp.Idx+1<<uint(length) {
+		return ErrInvalidPos
+	}
+	if len(mp.Value) != HASH_SIZE {
+		return ErrInvalidValue
+	}
+	for _, hash := range mp.Branch {
+		if len(hash) != HASH_SIZE {
+			return ErrInvalidHashLength
+		}
+	}
+	return nil
+}
+
+// Binary encoding:
+// idx (8 bytes, big endian), value, branch length (1 byte), branch hashes
+// Pos is not encoded since it follows from idx and branch length
+
+func (mp *Proof) MarshalBinary() ([]byte, error) {
+	if err := mp.Validate(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 9+HASH_SIZE*(len(mp.Branch)+1))
+	data = append(data, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(data, uint64(mp.Idx))
+	data = append(data, mp.Value...)
+	data = append(data, byte(len(mp.Branch)))
+	for _, hash := range mp.Branch {
+		data = append(data, hash...)
+	}
+	return data, nil
+}
+
+// Reads a proof from the start of data,
+// returns the number of bytes read
+func ReadProof(data []byte) (*Proof, int, error) {
+	if len(data) < 9+HASH_SIZE {
+		return nil, 0, ErrProofSize
+	}
+	idx := binary.BigEndian.Uint64(data[:8])
+	if idx >= 1<<MAX_TREE_HEIGHT {
+		return nil, 0, ErrInvalidIdx
+	}
+	n := 8
+	value := make([]byte, HASH_SIZE)
+	n += copy(value, data[n:n+HASH_SIZE])
+	length := int(data[n])
+	n++
+	if length < 1 || length > MAX_TREE_HEIGHT {
+		return nil, 0, ErrInvalidBranch
+	}
+	if len(data) < n+length*HASH_SIZE {
+		return nil, 0, ErrProofSize
+	}
+	branch := make([][]byte, length)
+	for i := range branch {
+		branch[i] = make([]byte, HASH_SIZE)
+		n += copy(branch[i], data[n:n+HASH_SIZE])
+	}
+	mp := &Proof{
+		Branch: branch,
+		Idx:    int64(idx),
+		Pos:    int64(idx) + 1<<uint(length),
+		Value:  value,
+	}
+	if err := mp.Validate(); err != nil {
+		return nil, 0, err
+	}
+	return mp, n, nil
+}
+
+func (mp *Proof) UnmarshalBinary(data []byte) error {
+	p, n, err := ReadProof(data)
+	if err != nil {
+		return err
+	} else if n != len(data) {
+		return ErrProofSize
+	}
+	*mp = *p
+	return nil
+}
+
 // Get sibling and value from graph
+// Sibling is ignored when it is a padding leaf
 func (t *Tree) ComputeProof(idx int64, sibling, value []byte) *Proof {
 	if idx < 0 {
 		panic("Idxs cannot be less than 0")
@@ -140,6 +383,9 @@ func (t *Tree) ComputeProof(idx int64, sibling, value []byte) *Proof {
 	if idx >= t.numLeaves {
 		Panicf("Expected idx < %d; got idx=%d\n", t.numLeaves, idx)
 	}
+	if idx^1 >= t.numLeaves {
+		sibling = ZeroLeaf()
+	}
 	p := new(Proof)
 	p.Branch = append(p.Branch, sibling)
 	p.Idx = idx
@@ -150,25 +396,28 @@ func (t *Tree) ComputeProof(idx int64, sibling, value []byte) *Proof {
 		if pos >>= 1; pos == 1 {
 			return p
 		}
-		key := Int64Bytes(pos ^ 1)
-		val, err := t.db.Get(key, nil)
-		Check(err)
+		val, ok := t.cache.Get(pos ^ 1)
+		if !ok {
+			var err error
+			val, err = t.node(pos ^ 1)
+			Check(err)
+		}
 		p.Branch = append(p.Branch, val)
 	}
 }
 
 func VerifyProof(p *Proof, root []byte) bool {
-	hash := NewHash()
+	if p.Validate() != nil {
+		return false
+	}
 	pos := p.Pos
 	value := p.Value
 	for _, otherValue := range p.Branch {
-		hash.Reset()
 		if pos&1 == 0 {
-			hash.Write(append(value, otherValue...))
+			value = HashPair(value, otherValue)
 		} else {
-			hash.Write(append(otherValue, value...))
+			value = HashPair(otherValue, value)
 		}
-		value = hash.Sum(nil)
 		pos >>= 1
 	}
 	return bytes.Equal(root, value)
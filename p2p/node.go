@@ -61,7 +61,8 @@ func NewNode(config cfg.Config) *Node {
 	priv := tndr.PrivKeyFromB58(b58)
 	if input != "" {
 		bytes := MustReadFile(input)
-		parts := NewPartSetFromData(bytes, PART_SIZE)
+		parts, err := NewPartSetFromData(bytes, PART_SIZE)
+		Check(err)
 		dataReactor.SetParts(parts)
 	}
 	if output != "" {
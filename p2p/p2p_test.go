@@ -18,3 +18,39 @@ func TestTypes(t *testing.T) {
 	}
 	t.Log(string(p))
 }
+
+func TestPartMessage(t *testing.T) {
+	data := []byte("here is some data that will be in a part set")
+	partSet, err := NewPartSetFromData(data, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	header := partSet.Header()
+	received := NewPartSetFromHeader(header)
+	for idx := 0; idx < header.Total; idx++ {
+		part := partSet.GetPart(idx)
+		bz := EncodeMessage(&PartMessage{part})
+		_, msg, err := DecodeMessage(bz)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		partMsg, ok := msg.(*PartMessage)
+		if !ok {
+			t.Fatalf("Expected *PartMessage; got %T", msg)
+		}
+		if added, err := received.AddPart(partMsg.Part); !added || err != nil {
+			t.Fatalf("Could not add part with idx=%d: %v", idx, err)
+		}
+	}
+	if !received.IsComplete() {
+		t.Error("Expected part set to be complete")
+	}
+	part := &Part{
+		Bytes: []byte("x"),
+		Idx:   0,
+		Proof: partSet.GetPart(0).Proof,
+	}
+	if _, err = NewPartSetFromHeader(header).AddPart(part); err != ErrPartSetInvalidProof {
+		t.Errorf("Expected err=%v; got err=%v", ErrPartSetInvalidProof, err)
+	}
+}
@@ -278,12 +278,22 @@ var _ = wire.RegisterInterface(
 	wire.ConcreteType{&ShutdownMessage{}, SHUTDOWN},
 )
 
+func EncodeMessage(msg DataMessage) []byte {
+	return wire.BinaryBytes(struct{ DataMessage }{msg})
+}
+
 func DecodeMessage(bz []byte) (byte, DataMessage, error) {
+	if len(bz) == 0 {
+		return 0, nil, Error("Empty message")
+	}
 	msgType := bz[0]
 	n, err := new(int), new(error)
 	reader := bytes.NewReader(bz)
 	msg := wire.ReadBinary(struct{ DataMessage }{}, reader, MAX_MESSAGE_SIZE, n, err)
-	return msgType, msg, *err
+	if *err != nil {
+		return msgType, nil, *err
+	}
+	return msgType, msg.(struct{ DataMessage }).DataMessage, nil
 }
 
 type PartsHeaderMessage struct {
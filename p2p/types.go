@@ -107,7 +107,7 @@ type PartSet struct {
 	total int
 }
 
-func NewPartSetFromData(data []byte, partSize int) *PartSet {
+func NewPartSetFromData(data []byte, partSize int) (*PartSet, error) {
 	total := (len(data) + partSize - 1) / partSize
 	values := make([][]byte, total)
 	parts := make([]*Part, total)
@@ -130,10 +130,18 @@ func NewPartSetFromData(data []byte, partSize int) *PartSet {
 		values[i] = hash
 	}
 	tree := new(merkle.MemTree)
-	tree.Construct(values)
-	rootHash := tree.HashLevels()
+	if err := tree.Construct(values); err != nil {
+		return nil, err
+	}
+	rootHash, err := tree.HashLevels()
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < total; i++ {
-		parts[i].Proof = tree.ComputeMemProof(i)
+		parts[i].Proof, err = tree.ComputeMemProof(i)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &PartSet{
 		bits:  bits,
@@ -141,7 +149,7 @@ func NewPartSetFromData(data []byte, partSize int) *PartSet {
 		hash:  rootHash,
 		parts: parts,
 		total: total,
-	}
+	}, nil
 }
 
 func NewPartSetFromHeader(header PartSetHeader) *PartSet {
@@ -203,12 +211,15 @@ func (partSet *PartSet) HashesTo(hash []byte) bool {
 func (partSet *PartSet) AddPart(p *Part) (bool, error) {
 	partSet.mtx.Lock()
 	defer partSet.mtx.Unlock()
-	if p.Idx >= partSet.total {
+	if p.Idx < 0 || p.Idx >= partSet.total {
 		return false, ErrPartSetUnexpectedIndex
 	}
 	if partSet.parts[p.Idx] != nil {
 		return false, nil
 	}
+	if p.Proof == nil || p.Proof.Idx != p.Idx || !bytes.Equal(p.Proof.Hash, merkle.MemLeafHash(p.Hash())) {
+		return false, ErrPartSetInvalidProof
+	}
 	if !merkle.VerifyMemProof(p.Proof, partSet.hash) {
 		return false, ErrPartSetInvalidProof
 	}
@@ -0,0 +1,286 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/zbo14/pos/graph"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Audit re-verifies labels in a plot
+// A label is corrupted when its merkle proof does not verify
+// against the commit, or when it does not match the label
+// recomputed from its parents and all the parents verify.
+// A parent that fails to verify is reported as well,
+// whether or not it was sampled. A proof includes the
+// sibling label, so labels are reported in pairs.
+// In a replica, a sampled label slot that holds an encoded
+// chunk is also checked against the replica commit. Chunks
+// cannot be recomputed without the data, so a corrupted
+// chunk is reported but never repaired.
+
+var (
+	ErrChunksCorrupted = Error("Encoded chunks are corrupted and cannot be repaired")
+	ErrInvalidFraction = Error("Fraction must be in (0, 1]")
+	ErrRepairFailed    = Error("Plot root does not match commit after repair")
+)
+
+// Labels [Begin, End)
+type Range struct {
+	Begin int64 `json:"begin"`
+	End   int64 `json:"end"`
+}
+
+func (r *Range) String() string {
+	return Sprintf("[%d, %d)", r.Begin, r.End)
+}
+
+type AuditReport struct {
+	Checked         int64    `json:"checked"`
+	Corrupted       []*Range `json:"corrupted"`
+	CorruptedChunks []*Range `json:"corrupted_chunks,omitempty"`
+	Repaired        bool     `json:"repaired"`
+	RootCorrupted   bool     `json:"root_corrupted"`
+}
+
+func (report *AuditReport) String() string {
+	return Sprintf("AUDIT_REPORT(checked=%d,corrupted=%v,corrupted_chunks=%v,root_corrupted=%v,repaired=%v)", report.Checked, report.Corrupted, report.CorruptedChunks, report.RootCorrupted, report.Repaired)
+}
+
+func (report *AuditReport) NumCorrupted() (num int64) {
+	for _, r := range report.Corrupted {
+		num += r.End - r.Begin
+	}
+	return
+}
+
+// Checks a random fraction of the labels in a plot
+// If repair is set, corrupted labels are recomputed from
+// their parents and the merkle nodes above them are rehashed
+// Labels are repaired even if chunks are corrupted, then
+// ErrChunksCorrupted is returned with the report
+func AuditPlot(plot *Plot, fraction float64, repair bool) (*AuditReport, error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, ErrInvalidFraction
+	}
+	numLabels := plot.header.NumLabels
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	corrupted := make(map[int64]bool)
+	var chunks Int64s
+	report := new(AuditReport)
+	// Proofs are checked against the commit, not the stored root
+	root, err := plot.Node(1)
+	if err != nil {
+		return nil, err
+	}
+	report.RootCorrupted = !bytes.Equal(root, plot.header.Commit)
+	for idx := int64(0); idx < numLabels; idx++ {
+		if fraction < 1 && rng.Float64() >= fraction {
+			continue
+		}
+		report.Checked++
+		if err := plot.auditLabel(idx, corrupted); err != nil {
+			return nil, err
+		}
+		if plot.encodes(idx) {
+			i := idx - plot.header.chunkLabel(0)
+			if verified, err := plot.verifyChunk(i); err != nil {
+				return nil, err
+			} else if !verified {
+				chunks = append(chunks, i)
+			}
+		}
+	}
+	idxs := make(Int64s, 0, len(corrupted))
+	for idx := range corrupted {
+		idxs = append(idxs, idx)
+	}
+	sort.Sort(idxs)
+	report.Corrupted = toRanges(idxs)
+	report.CorruptedChunks = toRanges(chunks)
+	if repair && (len(idxs) > 0 || report.RootCorrupted) {
+		if err := plot.repair(idxs); err != nil {
+			return report, err
+		}
+		report.Repaired = true
+	}
+	if repair && len(chunks) > 0 {
+		return report, ErrChunksCorrupted
+	}
+	return report, nil
+}
+
+func (plot *Plot) verifyChunk(i int64) (bool, error) {
+	p, err := plot.replica.computeProof(i)
+	if err != nil {
+		return false, err
+	}
+	return merkle.VerifyProof(p, plot.header.ReplicaCommit), nil
+}
+
+func (plot *Plot) verifyLabel(idx int64) (bool, error) {
+	p, err := plot.ComputeProof(idx)
+	if err != nil {
+		return false, err
+	}
+	return merkle.VerifyProof(p, plot.header.Commit), nil
+}
+
+// Parent labels are read with label, so a repair
+// can recompute from labels it has not written yet
+func (plot *Plot) recomputeLabel(idx int64, label func(int64) ([]byte, error)) ([]byte, Int64s, error) {
+	parents, err := plot.Parents(idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([][]byte, len(parents))
+	for i, parent := range parents {
+		value, err := label(parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = value
+	}
+	header := plot.header
+	return graph.Label(header.PubKey, header.Id, idx, values), parents, nil
+}
+
+func (plot *Plot) auditLabel(idx int64, corrupted map[int64]bool) error {
+	verified, err := plot.verifyLabel(idx)
+	if err != nil {
+		return err
+	} else if !verified {
+		corrupted[idx] = true
+		return nil
+	}
+	value, err := plot.Label(idx)
+	if err != nil {
+		return err
+	}
+	recomputed, parents, err := plot.recomputeLabel(idx, plot.Label)
+	if err != nil {
+		return err
+	} else if bytes.Equal(value, recomputed) {
+		return nil
+	}
+	parentCorrupted := false
+	for _, parent := range parents {
+		if verified, err = plot.verifyLabel(parent); err != nil {
+			return err
+		} else if !verified {
+			corrupted[parent] = true
+			parentCorrupted = true
+		}
+	}
+	if !parentCorrupted {
+		corrupted[idx] = true
+	}
+	return nil
+}
+
+// Sorted idxs to ranges of consecutive idxs
+func toRanges(idxs Int64s) (ranges []*Range) {
+	for _, idx := range idxs {
+		if n := len(ranges); n > 0 && ranges[n-1].End == idx {
+			ranges[n-1].End++
+		} else {
+			ranges = append(ranges, &Range{idx, idx + 1})
+		}
+	}
+	return
+}
+
+// Recomputed labels and rehashed merkle nodes,
+// keyed by heap position, not yet written to the plot
+type repairBuffer struct {
+	plot   *Plot
+	tree   *plotTree
+	values map[int64][]byte
+}
+
+func (buf *repairBuffer) node(pos int64) ([]byte, error) {
+	if value, ok := buf.values[pos]; ok {
+		return value, nil
+	}
+	if idx := pos - buf.tree.numNodes - 1; idx >= 0 && idx < buf.tree.numLeaves {
+		return buf.plot.Label(idx)
+	}
+	return buf.tree.readNodes(pos, 1)
+}
+
+func (buf *repairBuffer) label(idx int64) ([]byte, error) {
+	return buf.node(idx + buf.tree.numNodes + 1)
+}
+
+func (buf *repairBuffer) rehash(pos int64) error {
+	left, err := buf.node(pos << 1)
+	if err != nil {
+		return err
+	}
+	right, err := buf.node(pos<<1 | 1)
+	if err != nil {
+		return err
+	}
+	buf.values[pos] = merkle.HashPair(left, right)
+	return nil
+}
+
+// Labels are recomputed in idx order, so parents are
+// repaired before their children. Nothing is written
+// unless the recomputed root matches the commit.
+// Recomputed labels of encoded slots are only hashed,
+// writing them would overwrite the encoded chunks.
+func (plot *Plot) repair(idxs Int64s) error {
+	tree := plot.labels
+	buf := &repairBuffer{plot, tree, make(map[int64][]byte)}
+	positions := make(map[int64]bool)
+	for _, idx := range idxs {
+		value, _, err := plot.recomputeLabel(idx, buf.label)
+		if err != nil {
+			return err
+		}
+		pos := idx + tree.numNodes + 1
+		buf.values[pos] = value
+		positions[pos>>1] = true
+	}
+	if len(positions) == 0 {
+		// only the root is corrupted
+		positions[1] = true
+	}
+	// Rehash merkle nodes level by level up to the root,
+	// siblings are rehashed since they are in the branches
+	for len(positions) > 0 {
+		next := make(map[int64]bool)
+		for pos := range positions {
+			if pos > 1 {
+				if err := buf.rehash(pos ^ 1); err != nil {
+					return err
+				}
+				next[pos>>1] = true
+			}
+			if err := buf.rehash(pos); err != nil {
+				return err
+			}
+		}
+		positions = next
+	}
+	if !bytes.Equal(buf.values[1], plot.header.Commit) {
+		return ErrRepairFailed
+	}
+	for pos, value := range buf.values {
+		offset := tree.nodeOffset(pos)
+		if idx := pos - tree.numNodes - 1; plot.encodes(idx) {
+			continue
+		} else if idx >= 0 {
+			offset = tree.leafOffset(idx)
+		}
+		if _, err := plot.file.WriteAt(value, offset); err != nil {
+			return err
+		}
+		tree.cache.Update(pos, value)
+	}
+	return plot.file.Sync()
+}
@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"sync"
+)
+
+// Batch verification of space proofs
+// Proofs are verified in parallel and identical proofs
+// for the same commit are verified once. Merkle nodes on
+// verified paths are cached per commit, so a later path
+// that reaches a cached node is verified without hashing
+// up to the root. Space proofs for the same commit share
+// the upper levels of their paths, so only the top
+// BATCH_CACHE_LEVELS levels are cached, and the cache
+// is cleared on reset.
+
+const BATCH_CACHE_LEVELS = 16
+
+type BatchVerifier struct {
+	commits [][]byte
+	nodes   *nodeCache
+	params  *Params
+	proofs  []*SpaceProof
+	workers int
+}
+
+func NewBatchVerifier(params *Params, workers int) *BatchVerifier {
+	if workers < 1 {
+		workers = 1
+	}
+	return &BatchVerifier{
+		nodes:   newNodeCache(treeHeight(params.GraphSize())),
+		params:  params,
+		workers: workers,
+	}
+}
+
+// Returns the idx of the proof in the results
+func (bv *BatchVerifier) Add(commit []byte, spaceProof *SpaceProof) int {
+	bv.commits = append(bv.commits, commit)
+	bv.proofs = append(bv.proofs, spaceProof)
+	return len(bv.proofs) - 1
+}
+
+func (bv *BatchVerifier) Len() int {
+	return len(bv.proofs)
+}
+
+// Removes the added proofs and cached nodes
+func (bv *BatchVerifier) Reset() {
+	bv.commits = nil
+	bv.nodes = newNodeCache(bv.nodes.height)
+	bv.proofs = nil
+}
+
+// Verifies the added proofs, the error for each
+// proof is at its idx and nil if the proof verified
+func (bv *BatchVerifier) Verify() []error {
+	results := make([]error, len(bv.proofs))
+	// Identical proofs share the result of the first
+	first := make(map[string]int)
+	dups := make(map[int]int)
+	var unique []int
+	for i, spaceProof := range bv.proofs {
+		if spaceProof != nil {
+			if data, err := spaceProof.MarshalBinary(); err == nil {
+				key := string(bv.commits[i]) + string(data)
+				if j, ok := first[key]; ok {
+					dups[i] = j
+					continue
+				}
+				first[key] = i
+			}
+		}
+		unique = append(unique, i)
+	}
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < bv.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxs {
+				results[i] = bv.verify(bv.commits[i], bv.proofs[i])
+			}
+		}()
+	}
+	for _, i := range unique {
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+	for i, j := range dups {
+		results[i] = results[j]
+	}
+	return results
+}
+
+func (bv *BatchVerifier) verify(commit []byte, spaceProof *SpaceProof) error {
+	if spaceProof == nil {
+		return ErrNotVerified
+	}
+	pub, seed := spaceProof.PubKey, spaceProof.Seed
+	if err := checkProof(commit, pub, seed, spaceProof.Size, bv.params); err != nil {
+		return err
+	}
+	challenges := DeriveChallenges(commit, pub, seed, bv.params.Beta, spaceProof.Size)
+	return verifySpace(commit, challenges, bv.params.GraphSize(), spaceProof, bv.nodes.verifyProof)
+}
+
+// Nodes that are on a verified path to a commit
+
+type nodeCache struct {
+	height int // branch length of a label proof
+	mtx    sync.RWMutex
+	nodes  map[string][]byte
+}
+
+func (c *nodeCache) len() int {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return len(c.nodes)
+}
+
+func newNodeCache(height int) *nodeCache {
+	return &nodeCache{
+		height: height,
+		nodes:  make(map[string][]byte),
+	}
+}
+
+func nodeKey(commit []byte, pos int64) string {
+	return string(commit) + string(Int64Bytes(pos))
+}
+
+func (c *nodeCache) verified(commit []byte, pos int64, value []byte) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	cached, ok := c.nodes[nodeKey(commit, pos)]
+	return ok && bytes.Equal(cached, value)
+}
+
+// Same result as merkle.VerifyProof for a label proof
+// The branch must start at a leaf before cached nodes are
+// used, or a proof of an internal node could end at one
+func (c *nodeCache) verifyProof(p *merkle.Proof, commit []byte) bool {
+	if p.Validate() != nil || len(p.Branch) != c.height {
+		return false
+	}
+	// Nodes on the path and their siblings
+	path := make(map[int64][]byte)
+	pos, value := p.Pos, p.Value
+	verified := false
+	for _, otherValue := range p.Branch {
+		if verified = c.verified(commit, pos, value); verified {
+			break
+		}
+		path[pos], path[pos^1] = value, otherValue
+		if pos&1 == 0 {
+			value = merkle.HashPair(value, otherValue)
+		} else {
+			value = merkle.HashPair(otherValue, value)
+		}
+		pos >>= 1
+	}
+	if !verified && !bytes.Equal(value, commit) {
+		return false
+	}
+	c.mtx.Lock()
+	for pos, value := range path {
+		if pos < 1<<BATCH_CACHE_LEVELS {
+			c.nodes[nodeKey(commit, pos)] = value
+		}
+	}
+	c.mtx.Unlock()
+	return true
+}
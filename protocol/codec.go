@@ -0,0 +1,376 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+)
+
+// Canonical binary encoding of proofs
+// Integers are big endian, and every valid encoding
+// decodes to a proof that encodes to the same bytes.
+//
+// commit proof: type (1 byte), commit, id (8 bytes), public key,
+// seed length (1 byte), seed, size (8 bytes), num proofs (2 bytes),
+// then for each proof: merkle proof, num parents (1 byte), parent proofs
+//
+// space proof: type (1 byte), commit, public key, seed length (1 byte),
+// seed, size (8 bytes), num proofs (2 bytes), merkle proofs
+//
+// UnmarshalBinary only enforces the MAX_ limits. DecodeCommitProof
+// and DecodeSpaceProof take the limits from the params (num
+// challenges, seed size, in-degree and merkle tree height), so
+// counts are checked against them before anything is allocated.
+
+const (
+	COMMIT_PROOF_TYPE byte = 0x01
+	SPACE_PROOF_TYPE  byte = 0x02
+
+	MAX_NUM_CHALLENGES = 256
+	MAX_NUM_PARENTS    = 32
+	MAX_SEED_SIZE      = 255
+
+	proofHeaderSize = 1 + HASH_SIZE + 32 + 1 + MAX_SEED_SIZE + 8 + 2
+
+	MAX_COMMIT_PROOF_SIZE = proofHeaderSize + 8 + MAX_NUM_CHALLENGES*(1+(1+MAX_NUM_PARENTS)*merkle.MAX_PROOF_SIZE)
+	MAX_SPACE_PROOF_SIZE  = proofHeaderSize + MAX_NUM_CHALLENGES*merkle.MAX_PROOF_SIZE
+)
+
+var (
+	ErrInvalidEncoding = Error("Invalid proof encoding")
+	ErrProofTooLarge   = Error("Proof exceeds max size")
+)
+
+type encoder struct {
+	data []byte
+}
+
+func (enc *encoder) writeByte(b byte) {
+	enc.data = append(enc.data, b)
+}
+
+func (enc *encoder) write(bz []byte) {
+	enc.data = append(enc.data, bz...)
+}
+
+func (enc *encoder) writeUint16(i int) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(i))
+	enc.write(buf[:])
+}
+
+func (enc *encoder) writeUint64(i int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	enc.write(buf[:])
+}
+
+func (enc *encoder) writeProof(p *merkle.Proof) error {
+	if p == nil {
+		return ErrInvalidEncoding
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	enc.write(data)
+	return nil
+}
+
+func (enc *encoder) writeCommit(_type byte, commit []byte) error {
+	if len(commit) != HASH_SIZE {
+		return ErrInvalidEncoding
+	}
+	enc.writeByte(_type)
+	enc.write(commit)
+	return nil
+}
+
+// Fields common to commit and space proofs
+func (enc *encoder) writeFields(pub crypto.PubKeyEd25519, seed []byte, size int64, numProofs int) error {
+	if len(seed) > MAX_SEED_SIZE || size < 0 {
+		return ErrInvalidEncoding
+	} else if numProofs > MAX_NUM_CHALLENGES {
+		return ErrProofTooLarge
+	}
+	enc.write(pub[:])
+	enc.writeByte(byte(len(seed)))
+	enc.write(seed)
+	enc.writeUint64(size)
+	enc.writeUint16(numProofs)
+	return nil
+}
+
+// Max counts when decoding a proof
+// With params, every branch must have exactly the tree height
+type proofLimits struct {
+	exact      bool
+	height     int // merkle branch length
+	numParents int
+	numProofs  int
+	seedSize   int
+}
+
+var maxLimits = &proofLimits{false, merkle.MAX_TREE_HEIGHT, MAX_NUM_PARENTS, MAX_NUM_CHALLENGES, MAX_SEED_SIZE}
+
+// Parents are bounded by the in-degree of the last node
+// when the graph spec fixes it, commit proofs are only
+// decoded with params for those specs
+func newProofLimits(params *Params, numProofs int) *proofLimits {
+	size := params.GraphSize()
+	numParents := MAX_NUM_PARENTS
+	if n, ok := params.Graph.InDegree(size - 1); ok && n < MAX_NUM_PARENTS {
+		numParents = int(n)
+	}
+	height := treeHeight(size)
+	return &proofLimits{true, height, numParents, numProofs, params.SeedSize}
+}
+
+func (limits *proofLimits) proofSize() int {
+	return 9 + HASH_SIZE*(limits.height+1)
+}
+
+func (limits *proofLimits) headerSize() int {
+	return 1 + HASH_SIZE + 32 + 1 + limits.seedSize + 8 + 2
+}
+
+func (limits *proofLimits) commitProofSize() int {
+	return limits.headerSize() + 8 + limits.numProofs*(1+(1+limits.numParents)*limits.proofSize())
+}
+
+func (limits *proofLimits) spaceProofSize() int {
+	return limits.headerSize() + limits.numProofs*limits.proofSize()
+}
+
+type decoder struct {
+	data   []byte
+	err    error
+	limits *proofLimits
+}
+
+func (dec *decoder) read(n int) []byte {
+	if dec.err != nil {
+		return nil
+	}
+	if n > len(dec.data) {
+		dec.err = ErrInvalidEncoding
+		return nil
+	}
+	bz := make([]byte, n)
+	copy(bz, dec.data)
+	dec.data = dec.data[n:]
+	return bz
+}
+
+func (dec *decoder) readByte() byte {
+	if bz := dec.read(1); bz != nil {
+		return bz[0]
+	}
+	return 0
+}
+
+func (dec *decoder) readUint16() int {
+	if bz := dec.read(2); bz != nil {
+		return int(binary.BigEndian.Uint16(bz))
+	}
+	return 0
+}
+
+// Values that do not fit in int64 are invalid
+func (dec *decoder) readInt64() int64 {
+	bz := dec.read(8)
+	if bz == nil {
+		return 0
+	}
+	i := int64(binary.BigEndian.Uint64(bz))
+	if i < 0 {
+		dec.err = ErrInvalidEncoding
+	}
+	return i
+}
+
+func (dec *decoder) readProof() *merkle.Proof {
+	if dec.err != nil {
+		return nil
+	}
+	p, n, err := merkle.ReadProof(dec.data)
+	if err != nil {
+		dec.err = err
+		return nil
+	} else if len(p.Branch) > dec.limits.height {
+		dec.err = ErrProofTooLarge
+		return nil
+	} else if dec.limits.exact && len(p.Branch) != dec.limits.height {
+		dec.err = ErrIncorrectBranch
+		return nil
+	}
+	dec.data = dec.data[n:]
+	return p
+}
+
+func (dec *decoder) readSeed() []byte {
+	n := int(dec.readByte())
+	if n > dec.limits.seedSize {
+		dec.err = ErrProofTooLarge
+		return nil
+	}
+	return dec.read(n)
+}
+
+func (dec *decoder) done() error {
+	if dec.err == nil && len(dec.data) > 0 {
+		dec.err = ErrInvalidEncoding
+	}
+	return dec.err
+}
+
+func (commitProof *CommitProof) MarshalBinary() ([]byte, error) {
+	if len(commitProof.ParentProofs) != len(commitProof.Proofs) {
+		return nil, ErrIncorrectNumProofs
+	}
+	if commitProof.Id < 0 {
+		return nil, ErrInvalidEncoding
+	}
+	enc := new(encoder)
+	if err := enc.writeCommit(COMMIT_PROOF_TYPE, commitProof.Commit); err != nil {
+		return nil, err
+	}
+	enc.writeUint64(int64(commitProof.Id))
+	if err := enc.writeFields(commitProof.PubKey, commitProof.Seed, commitProof.Size, len(commitProof.Proofs)); err != nil {
+		return nil, err
+	}
+	for i, p := range commitProof.Proofs {
+		if err := enc.writeProof(p); err != nil {
+			return nil, err
+		}
+		parentProofs := commitProof.ParentProofs[i]
+		if len(parentProofs) > MAX_NUM_PARENTS {
+			return nil, ErrProofTooLarge
+		}
+		enc.writeByte(byte(len(parentProofs)))
+		for _, parentProof := range parentProofs {
+			if err := enc.writeProof(parentProof); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return enc.data, nil
+}
+
+func (commitProof *CommitProof) UnmarshalBinary(data []byte) error {
+	cp, err := decodeCommitProof(data, maxLimits)
+	if err != nil {
+		return err
+	}
+	*commitProof = *cp
+	return nil
+}
+
+func DecodeCommitProof(data []byte, params *Params) (*CommitProof, error) {
+	if !params.Graph.FixedInDegree() {
+		return nil, ErrInDegree
+	}
+	return decodeCommitProof(data, newProofLimits(params, params.Alpha))
+}
+
+func decodeCommitProof(data []byte, limits *proofLimits) (*CommitProof, error) {
+	if len(data) > limits.commitProofSize() {
+		return nil, ErrProofTooLarge
+	}
+	dec := &decoder{data: data, limits: limits}
+	if dec.readByte() != COMMIT_PROOF_TYPE {
+		return nil, ErrInvalidEncoding
+	}
+	cp := new(CommitProof)
+	cp.Commit = dec.read(HASH_SIZE)
+	cp.Id = int(dec.readInt64())
+	copy(cp.PubKey[:], dec.read(len(cp.PubKey)))
+	cp.Seed = dec.readSeed()
+	cp.Size = dec.readInt64()
+	numProofs := dec.readUint16()
+	if numProofs > limits.numProofs {
+		return nil, ErrProofTooLarge
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	cp.Proofs = make([]*merkle.Proof, numProofs)
+	cp.ParentProofs = make([][]*merkle.Proof, numProofs)
+	for i := range cp.Proofs {
+		cp.Proofs[i] = dec.readProof()
+		numParents := int(dec.readByte())
+		if numParents > limits.numParents {
+			return nil, ErrProofTooLarge
+		}
+		if numParents > 0 && dec.err == nil {
+			cp.ParentProofs[i] = make([]*merkle.Proof, numParents)
+			for j := range cp.ParentProofs[i] {
+				cp.ParentProofs[i][j] = dec.readProof()
+			}
+		}
+	}
+	if err := dec.done(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (spaceProof *SpaceProof) MarshalBinary() ([]byte, error) {
+	enc := new(encoder)
+	if err := enc.writeCommit(SPACE_PROOF_TYPE, spaceProof.Commit); err != nil {
+		return nil, err
+	}
+	if err := enc.writeFields(spaceProof.PubKey, spaceProof.Seed, spaceProof.Size, len(spaceProof.Proofs)); err != nil {
+		return nil, err
+	}
+	for _, p := range spaceProof.Proofs {
+		if err := enc.writeProof(p); err != nil {
+			return nil, err
+		}
+	}
+	return enc.data, nil
+}
+
+func (spaceProof *SpaceProof) UnmarshalBinary(data []byte) error {
+	sp, err := decodeSpaceProof(data, maxLimits)
+	if err != nil {
+		return err
+	}
+	*spaceProof = *sp
+	return nil
+}
+
+func DecodeSpaceProof(data []byte, params *Params) (*SpaceProof, error) {
+	return decodeSpaceProof(data, newProofLimits(params, params.Beta))
+}
+
+func decodeSpaceProof(data []byte, limits *proofLimits) (*SpaceProof, error) {
+	if len(data) > limits.spaceProofSize() {
+		return nil, ErrProofTooLarge
+	}
+	dec := &decoder{data: data, limits: limits}
+	if dec.readByte() != SPACE_PROOF_TYPE {
+		return nil, ErrInvalidEncoding
+	}
+	sp := new(SpaceProof)
+	sp.Commit = dec.read(HASH_SIZE)
+	copy(sp.PubKey[:], dec.read(len(sp.PubKey)))
+	sp.Seed = dec.readSeed()
+	sp.Size = dec.readInt64()
+	numProofs := dec.readUint16()
+	if numProofs > limits.numProofs {
+		return nil, ErrProofTooLarge
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	sp.Proofs = make([]*merkle.Proof, numProofs)
+	for i := range sp.Proofs {
+		sp.Proofs[i] = dec.readProof()
+	}
+	if err := dec.done(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"github.com/zbo14/pos/graph"
+	. "github.com/zbo14/pos/util"
+	"math"
+	"time"
+)
+
+// Security parameters shared by prover and verifier
+
+const (
+	DEFAULT_DEADLINE  = time.Second
+	DEFAULT_FRACTION  = 0.5
+	DEFAULT_SEED_SIZE = 64
+	DEFAULT_SOUNDNESS = 1.0 / (1 << 16)
+)
+
+type Params struct {
+	Alpha     int           `json:"alpha"`    // number of commit challenges
+	Beta      int           `json:"beta"`     // number of space challenges
+	Deadline  time.Duration `json:"deadline"` // to respond to space challenges, 0 for none
+	Graph     *graph.Spec   `json:"graph"`
+	SeedSize  int           `json:"seed_size"`
+	Soundness float64       `json:"soundness"` // target soundness error
+}
+
+// A prover that stores (or correctly labeled) only a fraction
+// of the graph answers each challenge with probability <= fraction.
+// So num challenges give soundness error fraction^num.
+func NumChallenges(soundness, fraction float64) int {
+	if soundness <= 0 || soundness >= 1 {
+		Panicf("Expected 0 < soundness < 1; got soundness=%f", soundness)
+	}
+	if fraction <= 0 || fraction >= 1 {
+		Panicf("Expected 0 < fraction < 1; got fraction=%f", fraction)
+	}
+	num := math.Log(soundness) / math.Log(fraction)
+	// guard against float error when num is an integer
+	return int(math.Ceil(num - 1e-9))
+}
+
+func NewParams(spec *graph.Spec, soundness, fraction float64) *Params {
+	num := NumChallenges(soundness, fraction)
+	return &Params{
+		Alpha:     num,
+		Beta:      num,
+		Deadline:  DEFAULT_DEADLINE,
+		Graph:     spec,
+		SeedSize:  DEFAULT_SEED_SIZE,
+		Soundness: soundness,
+	}
+}
+
+func DefaultParams() *Params {
+	spec := graph.DefaultSpec(graph.STACKED_EXPANDERS)
+	return NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+}
+
+func (params *Params) GraphSize() int64 {
+	return params.Graph.Size()
+}
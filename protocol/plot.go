@@ -0,0 +1,586 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/graph"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A plot keeps a sector in a single self-describing file
+// [0, PLOT_HEADER_SIZE): magic, header length, JSON header, zero padding
+// then num_labels labels in idx order,
+// then num_nodes merkle nodes in heap order (root first),
+// then num_labels+1 parent offsets and num_parents parent idxs
+// A replica plot stores encoded chunks in place of the
+// first num_chunks last layer labels and is followed by
+// the merkle nodes over the chunks (see replica.go)
+// Each label, chunk and node is HASH_SIZE bytes
+// Parents are kept since random graph constructions
+// cannot be rebuilt with the same edges from the spec
+// Parent offsets are cumulative counts, so the parents
+// of label i are idxs [offset i, offset i+1), sorted as
+// they are when labels are set. Offsets and idxs are
+// 8 bytes, big endian
+
+const (
+	PLOT_CHUNK_SIZE  int64 = 4096
+	PLOT_EXT               = ".plot"
+	PLOT_HEADER_SIZE int64 = 4096
+	PLOT_MAGIC             = "POSPLOT\x00"
+	PLOT_VERSION           = 3
+)
+
+var (
+	ErrPlotExists  = Error("Plot file already exists")
+	ErrPlotHeader  = Error("Plot has invalid header")
+	ErrPlotMagic   = Error("File is not a plot")
+	ErrPlotParents = Error("Plot has invalid parents")
+	ErrPlotSize    = Error("Plot file has unexpected size")
+	ErrPlotVersion = Error("Plot has unexpected format version")
+)
+
+type PlotHeader struct {
+	Commit        []byte               `json:"commit"`
+	Created       int64                `json:"created"`
+	DataSize      int64                `json:"data_size,omitempty"`
+	Graph         *graph.Spec          `json:"graph"`
+	Hash          string               `json:"hash"`
+	Id            int                  `json:"id"`
+	NumChunks     int64                `json:"num_chunks,omitempty"`
+	NumLabels     int64                `json:"num_labels"`
+	NumNodes      int64                `json:"num_nodes"`
+	NumParents    int64                `json:"num_parents"`
+	PubKey        crypto.PubKeyEd25519 `json:"public_key"`
+	ReplicaCommit []byte               `json:"replica_commit,omitempty"`
+	Version       int                  `json:"version"`
+}
+
+func (header *PlotHeader) String() string {
+	return Sprintf("PLOT_HEADER(id=%d,commit=%x,graph=%v,created=%v)", header.Id, header.Commit, header.Graph, time.Unix(header.Created, 0))
+}
+
+// Merkle nodes for num labels padded to the next power of 2 (at least 2)
+func plotNumNodes(numLabels int64) int64 {
+	numPadded := GetPowOf2(numLabels)
+	if numPadded < 2 {
+		numPadded = 2
+	}
+	return numPadded - 1
+}
+
+func (header *PlotHeader) Validate() error {
+	var zero crypto.PubKeyEd25519
+	switch {
+	case header.Version != PLOT_VERSION:
+		return ErrPlotVersion
+	case header.Hash != merkle.HashName():
+		return merkle.ErrTreeHash
+	case header.Graph == nil,
+		header.PubKey == zero,
+		len(header.Commit) != HASH_SIZE,
+		header.NumLabels < 1,
+		header.NumLabels != header.Graph.Size(),
+		header.NumNodes != plotNumNodes(header.NumLabels),
+		header.NumParents < 0 || header.NumParents > header.NumLabels*MAX_NUM_PARENTS:
+		return ErrPlotHeader
+	}
+	if header.IsReplica() {
+		return header.validateReplica()
+	} else if header.DataSize != 0 || header.ReplicaCommit != nil {
+		return ErrPlotHeader
+	}
+	return nil
+}
+
+func (header *PlotHeader) IsReplica() bool {
+	return header.NumChunks > 0
+}
+
+func (header *PlotHeader) FileSize() int64 {
+	size := header.parentsEnd()
+	if header.IsReplica() {
+		size += plotNumNodes(header.NumChunks) * HASH_SIZE
+	}
+	return size
+}
+
+func (header *PlotHeader) parentsOffset() int64 {
+	return PLOT_HEADER_SIZE + (header.NumLabels+header.NumNodes)*HASH_SIZE
+}
+
+// Offset of the section after the parents
+func (header *PlotHeader) parentsEnd() int64 {
+	return header.parentsOffset() + (header.NumLabels+1+header.NumParents)*8
+}
+
+func PlotPath(dir string, id int) string {
+	return filepath.Join(dir, Sprintf("%d%s", id, PLOT_EXT))
+}
+
+// Merkle tree over leaves kept in the plot file,
+// leaves are followed by nodes in heap order
+
+type plotTree struct {
+	cache     *merkle.NodeCache
+	file      *os.File
+	nodes     int64 // offset of the merkle nodes
+	numLeaves int64
+	numNodes  int64
+	offset    int64
+}
+
+func newPlotTree(file *os.File, offset, numLeaves int64) *plotTree {
+	return &plotTree{
+		file:      file,
+		nodes:     offset + numLeaves*HASH_SIZE,
+		numLeaves: numLeaves,
+		numNodes:  plotNumNodes(numLeaves),
+		offset:    offset,
+	}
+}
+
+func (tree *plotTree) leafOffset(idx int64) int64 {
+	return tree.offset + idx*HASH_SIZE
+}
+
+func (tree *plotTree) nodeOffset(pos int64) int64 {
+	return tree.nodes + (pos-1)*HASH_SIZE
+}
+
+// Hashes each level from the one above it,
+// positions past num_nodes are leaves or padding
+func (tree *plotTree) hashLevels() error {
+	out := make([]byte, 0, PLOT_CHUNK_SIZE*HASH_SIZE)
+	for width := (tree.numNodes + 1) >> 1; width > 0; width >>= 1 {
+		for begin := width; begin < width<<1; begin += PLOT_CHUNK_SIZE {
+			n := width<<1 - begin
+			if n > PLOT_CHUNK_SIZE {
+				n = PLOT_CHUNK_SIZE
+			}
+			children, err := tree.readNodes(begin<<1, n<<1)
+			if err != nil {
+				return err
+			}
+			out = out[:0]
+			for i := int64(0); i < n<<1; i += 2 {
+				left := children[i*HASH_SIZE : (i+1)*HASH_SIZE]
+				right := children[(i+1)*HASH_SIZE : (i+2)*HASH_SIZE]
+				out = append(out, merkle.HashPair(left, right)...)
+			}
+			if _, err = tree.file.WriteAt(out, tree.nodeOffset(begin)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reads n consecutive nodes or leaves starting at pos
+func (tree *plotTree) readNodes(pos, n int64) ([]byte, error) {
+	buf := make([]byte, n*HASH_SIZE)
+	if pos <= tree.numNodes {
+		_, err := tree.file.ReadAt(buf, tree.nodeOffset(pos))
+		return buf, err
+	}
+	idx := pos - tree.numNodes - 1
+	if idx >= tree.numLeaves {
+		return buf, nil
+	}
+	if rem := tree.numLeaves - idx; n > rem {
+		n = rem
+	}
+	// leaves past num_leaves are zero padding
+	_, err := tree.file.ReadAt(buf[:n*HASH_SIZE], tree.leafOffset(idx))
+	return buf, err
+}
+
+func (tree *plotTree) leaf(idx int64) ([]byte, error) {
+	if idx < 0 || idx >= tree.numLeaves {
+		return nil, merkle.ErrInvalidIdx
+	}
+	return tree.readNodes(idx+tree.numNodes+1, 1)
+}
+
+func (tree *plotTree) node(pos int64) ([]byte, error) {
+	if pos < 1 || pos > tree.numNodes {
+		return nil, merkle.ErrInvalidIdx
+	}
+	return tree.readNodes(pos, 1)
+}
+
+func (tree *plotTree) computeProof(idx int64) (*merkle.Proof, error) {
+	value, err := tree.leaf(idx)
+	if err != nil {
+		return nil, err
+	}
+	pos := idx + tree.numNodes + 1
+	p := &merkle.Proof{
+		Idx:   idx,
+		Pos:   pos,
+		Value: value,
+	}
+	for ; pos > 1; pos >>= 1 {
+		sibling, ok := tree.cache.Get(pos ^ 1)
+		if !ok {
+			if sibling, err = tree.readNodes(pos^1, 1); err != nil {
+				return nil, err
+			}
+		}
+		p.Branch = append(p.Branch, sibling)
+	}
+	return p, nil
+}
+
+func (tree *plotTree) cacheLevels(levels int) error {
+	cache, err := merkle.NewNodeCache(levels, tree.numNodes, tree.node)
+	if err != nil {
+		return err
+	}
+	tree.cache = cache
+	return nil
+}
+
+func (tree *plotTree) checkRoot(commit []byte) error {
+	root, err := tree.node(1)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(root, commit) {
+		return merkle.ErrRootMismatch
+	}
+	return nil
+}
+
+type Plot struct {
+	file    *os.File
+	header  *PlotHeader
+	labels  *plotTree
+	path    string
+	replica *plotTree
+}
+
+func (plot *Plot) Header() *PlotHeader {
+	return plot.header
+}
+
+func (plot *Plot) Path() string {
+	return plot.path
+}
+
+func (plot *Plot) Close() error {
+	return plot.file.Close()
+}
+
+// Labels the graph with the public key, writes the labels
+// and merkle nodes to a new file at path
+func CreatePlot(path string, id int, pub crypto.PubKeyEd25519, spec *graph.Spec) (*Plot, error) {
+	return createPlot(path, id, pub, spec, nil)
+}
+
+func createPlot(path string, id int, pub crypto.PubKeyEd25519, spec *graph.Spec, data []byte) (*Plot, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, ErrPlotExists
+	} else if err != nil {
+		return nil, err
+	}
+	numLabels := spec.Size()
+	plot := &Plot{
+		file: file,
+		header: &PlotHeader{
+			Commit:    make([]byte, HASH_SIZE),
+			Created:   time.Now().Unix(),
+			Graph:     spec,
+			Hash:      merkle.HashName(),
+			Id:        id,
+			NumLabels: numLabels,
+			NumNodes:  plotNumNodes(numLabels),
+			PubKey:    pub,
+			Version:   PLOT_VERSION,
+		},
+		path: path,
+	}
+	plot.labels = newPlotTree(file, PLOT_HEADER_SIZE, numLabels)
+	if err = plot.create(data); err != nil {
+		plot.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err = file.Sync(); err != nil {
+		plot.Close()
+		return nil, err
+	}
+	return plot, nil
+}
+
+// The graph is built in a temporary leveldb next to the
+// plot, so it cannot collide with a sector's graph
+func (plot *Plot) create(data []byte) error {
+	header := plot.header
+	dir, err := ioutil.TempDir(filepath.Dir(plot.path), "graph")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	g := graph.ConstructAt(dir, header.Id, header.Graph)
+	defer g.Close()
+	g.SetValues(header.PubKey)
+	if err := plot.writeHeader(); err != nil {
+		return err
+	}
+	buf := make([]byte, 0, PLOT_CHUNK_SIZE*HASH_SIZE)
+	offset := PLOT_HEADER_SIZE
+	for idx := int64(0); idx < header.NumLabels; idx++ {
+		buf = append(buf, g.Get(idx).Value...)
+		if int64(len(buf)) == PLOT_CHUNK_SIZE*HASH_SIZE || idx == header.NumLabels-1 {
+			if _, err := plot.file.WriteAt(buf, offset); err != nil {
+				return err
+			}
+			offset += int64(len(buf))
+			buf = buf[:0]
+		}
+	}
+	if err := plot.labels.hashLevels(); err != nil {
+		return err
+	}
+	root, err := plot.Node(1)
+	if err != nil {
+		return err
+	}
+	header.Commit = root
+	if err = plot.writeParents(g); err != nil {
+		return err
+	}
+	if data != nil {
+		plot.initReplica(data)
+		if err = plot.encode(data); err != nil {
+			return err
+		}
+	}
+	return plot.writeHeader()
+}
+
+func (plot *Plot) writeParents(g *graph.Graph) error {
+	header := plot.header
+	offsets := make([]byte, 0, PLOT_CHUNK_SIZE*8)
+	idxs := make([]byte, 0, PLOT_CHUNK_SIZE*8)
+	offsetsAt, idxsAt := header.parentsOffset(), header.parentsOffset()+(header.NumLabels+1)*8
+	flush := func(buf []byte, at *int64) error {
+		if _, err := plot.file.WriteAt(buf, *at); err != nil {
+			return err
+		}
+		*at += int64(len(buf))
+		return nil
+	}
+	var numParents int64
+	for idx := int64(0); idx <= header.NumLabels; idx++ {
+		offsets = appendUint64(offsets, uint64(numParents))
+		if idx < header.NumLabels {
+			parents := g.GetParents(idx)
+			sort.Sort(parents)
+			for _, parent := range parents {
+				idxs = appendUint64(idxs, uint64(parent))
+				if len(idxs) == cap(idxs) {
+					if err := flush(idxs, &idxsAt); err != nil {
+						return err
+					}
+					idxs = idxs[:0]
+				}
+			}
+			numParents += int64(len(parents))
+		}
+		if len(offsets) == cap(offsets) || idx == header.NumLabels {
+			if err := flush(offsets, &offsetsAt); err != nil {
+				return err
+			}
+			offsets = offsets[:0]
+		}
+	}
+	header.NumParents = numParents
+	return flush(idxs, &idxsAt)
+}
+
+func appendUint64(buf []byte, x uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], x)
+	return append(buf, b[:]...)
+}
+
+func (plot *Plot) writeHeader() error {
+	data := MarshalJSON(plot.header)
+	if int64(len(data)) > PLOT_HEADER_SIZE-16 {
+		return ErrPlotHeader
+	}
+	buf := make([]byte, PLOT_HEADER_SIZE)
+	copy(buf, PLOT_MAGIC)
+	copy(buf[8:16], Int64Bytes(int64(len(data))))
+	copy(buf[16:], data)
+	_, err := plot.file.WriteAt(buf, 0)
+	return err
+}
+
+// Last layer labels that encode chunks in a replica
+// are recomputed from their parents
+func (plot *Plot) Label(idx int64) ([]byte, error) {
+	if plot.encodes(idx) {
+		value, _, err := plot.recomputeLabel(idx, plot.Label)
+		return value, err
+	}
+	return plot.labels.leaf(idx)
+}
+
+// Merkle node at heap position pos (root is 1)
+func (plot *Plot) Node(pos int64) ([]byte, error) {
+	return plot.labels.node(pos)
+}
+
+func (plot *Plot) ComputeProof(idx int64) (*merkle.Proof, error) {
+	p, err := plot.labels.computeProof(idx)
+	if err != nil {
+		return nil, err
+	}
+	if plot.encodes(idx) {
+		if p.Value, err = plot.Label(idx); err != nil {
+			return nil, err
+		}
+	}
+	// the first branch node is the sibling label
+	if sibling := idx ^ 1; plot.encodes(sibling) {
+		if p.Branch[0], err = plot.Label(sibling); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Parents are read from the plot, sorted as they are
+// when labels are set, and always precede the label
+func (plot *Plot) Parents(idx int64) (Int64s, error) {
+	header := plot.header
+	if idx < 0 || idx >= header.NumLabels {
+		return nil, merkle.ErrInvalidIdx
+	}
+	buf := make([]byte, 16)
+	if _, err := plot.file.ReadAt(buf, header.parentsOffset()+idx*8); err != nil {
+		return nil, err
+	}
+	begin, end := binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:])
+	if begin > end || end > uint64(header.NumParents) || end-begin > MAX_NUM_PARENTS {
+		return nil, ErrPlotParents
+	}
+	buf = make([]byte, (end-begin)*8)
+	if _, err := plot.file.ReadAt(buf, header.parentsOffset()+(header.NumLabels+1+int64(begin))*8); err != nil {
+		return nil, err
+	}
+	parents := make(Int64s, end-begin)
+	for i := range parents {
+		parent := binary.BigEndian.Uint64(buf[i*8:])
+		if parent >= uint64(idx) || (i > 0 && int64(parent) <= parents[i-1]) {
+			return nil, ErrPlotParents
+		}
+		parents[i] = int64(parent)
+	}
+	return parents, nil
+}
+
+// Opens and validates a plot, the file can be moved
+// since everything needed to prove is in the file
+func OpenPlot(path string) (*Plot, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	plot := &Plot{
+		file: file,
+		path: path,
+	}
+	if err = plot.open(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return plot, nil
+}
+
+func (plot *Plot) open() error {
+	header, err := readPlotHeader(plot.file)
+	if err != nil {
+		return err
+	}
+	info, err := plot.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != header.FileSize() {
+		return ErrPlotSize
+	}
+	plot.header = header
+	plot.labels = newPlotTree(plot.file, PLOT_HEADER_SIZE, header.NumLabels)
+	if err = plot.labels.checkRoot(header.Commit); err != nil {
+		return err
+	}
+	if header.IsReplica() {
+		plot.replica = newReplicaTree(plot.file, header)
+		return plot.replica.checkRoot(header.ReplicaCommit)
+	}
+	return nil
+}
+
+func readPlotHeader(file *os.File) (*PlotHeader, error) {
+	buf := make([]byte, PLOT_HEADER_SIZE)
+	if n, err := file.ReadAt(buf, 0); n < 16 {
+		if err == nil {
+			err = ErrPlotMagic
+		}
+		return nil, err
+	}
+	if string(buf[:8]) != PLOT_MAGIC {
+		return nil, ErrPlotMagic
+	}
+	size, _ := binary.Varint(buf[8:16])
+	if size < 1 || size > PLOT_HEADER_SIZE-16 {
+		return nil, ErrPlotHeader
+	}
+	header := new(PlotHeader)
+	if err := ReadJSON(bytes.NewReader(buf[16:16+size]), header); err != nil {
+		return nil, ErrPlotHeader
+	}
+	if err := header.Validate(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Headers of the plots in dir
+func ListPlots(dir string) ([]*PlotHeader, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var headers []*PlotHeader
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != PLOT_EXT {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		header, err := readPlotHeader(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
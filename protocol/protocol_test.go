@@ -0,0 +1,1126 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/zbo14/pos/crypto/tndr"
+	"github.com/zbo14/pos/graph"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	ID       = 0
+	PASSWORD = "it's a secret"
+)
+
+var seed1, seed2 = make([]byte, DEFAULT_SEED_SIZE), make([]byte, DEFAULT_SEED_SIZE)
+
+func init() {
+	seed2[0] = 1
+}
+
+func testParams() *Params {
+	spec := graph.DefaultSpec(graph.DOUBLE_BUTTERFLY)
+	return NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+}
+
+func newTestProver(id int) (*Prover, *Sector) {
+	priv := tndr.GeneratePrivKey(PASSWORD)
+	p := NewProver(priv, testParams())
+	return p, p.MustAddSector(id)
+}
+
+func newTestVerifier(p *Prover) *Verifier {
+	return NewVerifier(p.Params())
+}
+
+func cleanup() {
+	os.RemoveAll("Graph")
+	os.RemoveAll("plot")
+	os.RemoveAll("tree")
+}
+
+func TestSession(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	v := newTestVerifier(p)
+	s, err := v.NewSession(sec.Commit, p.PubKey())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Space challenges before commit is verified
+	if _, err = s.SpaceChallenges(seed1); err == nil {
+		t.Fatal("Expected error for space challenges in state=committed")
+	}
+	if err = s.VerifyCommit(new(CommitProof)); err != ErrNoChallenges {
+		t.Fatalf("Expected err=%v; got err=%v", ErrNoChallenges, err)
+	}
+	challenges, err := s.CommitChallenges(seed1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Challenges cannot be redrawn
+	if _, err = s.CommitChallenges(seed2); err == nil {
+		t.Fatal("Expected error for commit challenges in state=commit_challenged")
+	}
+	if err = s.VerifyCommitNI(sec.ProveCommitNI(seed2)); err == nil {
+		t.Fatal("Expected error for verify commit NI in state=commit_challenged")
+	}
+	// Challenges for another session do not affect this one
+	other, _ := v.NewSession(sec.Commit, p.PubKey())
+	if _, err = other.CommitChallenges(seed2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = s.VerifyCommit(sec.ProveCommit(challenges)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if state := s.State(); state != COMMIT_VERIFIED {
+		t.Fatalf("Expected state=%v; got state=%v", COMMIT_VERIFIED, state)
+	}
+	if _, err = s.CommitChallenges(seed1); err == nil {
+		t.Fatal("Expected error for commit challenges in state=commit_verified")
+	}
+	if err = s.VerifySpace(new(SpaceProof)); err == nil {
+		t.Fatal("Expected error for verify space in state=commit_verified")
+	}
+	for _, seed := range [][]byte{seed1, seed2} {
+		challenges, err = s.SpaceChallenges(seed)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err = s.SpaceChallenges(seed); err == nil {
+			t.Fatal("Expected error for space challenges in state=space_challenged")
+		}
+		if err = s.VerifySpace(sec.ProveSpace(challenges)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if state := s.State(); state != SPACE_VERIFIED {
+			t.Fatalf("Expected state=%v; got state=%v", SPACE_VERIFIED, state)
+		}
+	}
+}
+
+func TestNonInteractive(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	v := newTestVerifier(p)
+	commitProof := sec.ProveCommitNI(seed1)
+	spaceProof := sec.ProveSpaceNI(seed2)
+	// Tampered seed
+	s, _ := v.NewSession(sec.Commit, p.PubKey())
+	commitProof.Seed = seed2
+	if err := s.VerifyCommitNI(commitProof); err == nil {
+		t.Fatal("Expected error for commit proof with tampered seed")
+	}
+	commitProof.Seed = seed1
+	// Tampered commit
+	commit := make([]byte, len(sec.Commit))
+	copy(commit, sec.Commit)
+	commit[0] ^= 1
+	tampered, _ := v.NewSession(commit, p.PubKey())
+	if err := tampered.VerifyCommitNI(commitProof); err == nil {
+		t.Fatal("Expected error for commit proof with tampered commit")
+	}
+	if err := s.VerifyCommitNI(commitProof); err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceProof.Seed = seed1
+	if err := s.VerifySpaceNI(spaceProof); err == nil {
+		t.Fatal("Expected error for space proof with tampered seed")
+	}
+	spaceProof.Seed = seed2
+	if err := s.VerifySpaceNI(spaceProof); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestCommitParents(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := p.Params()
+	commitProof := sec.ProveCommitNI(seed1)
+	// Challenge with the most parents
+	var c int
+	for i, parentProofs := range commitProof.ParentProofs {
+		if len(parentProofs) > len(commitProof.ParentProofs[c]) {
+			c = i
+		}
+	}
+	parentProofs := commitProof.ParentProofs[c]
+	if len(parentProofs) != 3 {
+		t.Fatalf("Expected 3 parents; got %d parents", len(parentProofs))
+	}
+	tests := []struct {
+		name         string
+		parentProofs []*merkle.Proof
+		err          error
+	}{
+		{"reordered", []*merkle.Proof{parentProofs[1], parentProofs[0], parentProofs[2]}, ErrParentOrder},
+		{"missing", parentProofs[:2], ErrIncorrectNumParents},
+		{"duplicated", []*merkle.Proof{parentProofs[0], parentProofs[0], parentProofs[2]}, ErrParentOrder},
+		{"extra", append(parentProofs[:3:3], parentProofs[2]), ErrIncorrectNumParents},
+	}
+	for _, test := range tests {
+		commitProof.ParentProofs[c] = test.parentProofs
+		if err := VerifyCommitProof(sec.Commit, commitProof, params); err != test.err {
+			t.Errorf("%s parents: expected err=%v; got err=%v", test.name, test.err, err)
+		}
+	}
+	commitProof.ParentProofs[c] = parentProofs
+	if err := VerifyCommitProof(sec.Commit, commitProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Label is recomputed with the graph id
+	commitProof.Id++
+	if err := VerifyCommitProof(sec.Commit, commitProof, params); err != ErrIncorrectValue {
+		t.Errorf("Expected err=%v; got err=%v", ErrIncorrectValue, err)
+	}
+}
+
+func TestStatelessVerification(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := testParams()
+	commitProof := sec.ProveCommitNI(seed1)
+	if err := VerifyCommitProof(sec.Commit, commitProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceProof := sec.ProveSpaceNI(seed2)
+	if err := VerifySpaceProof(sec.Commit, spaceProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Wrong public key
+	other := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD + "!"))
+	spaceProof.PubKey = other
+	if err := VerifySpaceProof(sec.Commit, spaceProof, params); err == nil {
+		t.Error("Expected error for space proof with wrong public key")
+	}
+	spaceProof.PubKey = p.PubKey()
+	// Wrong size
+	commitProof.Size++
+	if err := VerifyCommitProof(sec.Commit, commitProof, params); err != ErrIncorrectSize {
+		t.Errorf("Expected err=%v; got err=%v", ErrIncorrectSize, err)
+	}
+	commitProof.Size--
+	// Wrong params
+	params.Beta++
+	if err := VerifySpaceProof(sec.Commit, spaceProof, params); err != ErrIncorrectNumProofs {
+		t.Errorf("Expected err=%v; got err=%v", ErrIncorrectNumProofs, err)
+	}
+}
+
+// Proof of the internal node above labels 2c and 2c+1,
+// presented as the proof of label c
+func shortBranchProof(sec *Sector, c int64) *merkle.Proof {
+	p := sec.ProveSpace(Int64s{2 * c}).Proofs[0]
+	return &merkle.Proof{
+		Branch: p.Branch[1:],
+		Idx:    c,
+		Pos:    c + 1<<uint(len(p.Branch)-1),
+		Value:  merkle.HashPair(p.Value, p.Branch[0]),
+	}
+}
+
+func TestShortBranch(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := p.Params()
+	forged := shortBranchProof(sec, 1)
+	if !merkle.VerifyProof(forged, sec.Commit) {
+		t.Fatal("Expected forged proof to verify against the commit")
+	}
+	spaceProof := sec.NewSpaceProof([]*merkle.Proof{forged})
+	if err := verifySpace(sec.Commit, Int64s{1}, params.GraphSize(), spaceProof, merkle.VerifyProof); err != ErrIncorrectBranch {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectBranch, err)
+	}
+	// Size must match the params, or the height would follow it
+	spaceProof.Size = 1 << uint(len(forged.Branch))
+	if err := verifySpace(sec.Commit, Int64s{1}, params.GraphSize(), spaceProof, merkle.VerifyProof); err != ErrIncorrectSize {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectSize, err)
+	}
+	commitProof := sec.ProveCommit(Int64s{1})
+	commitProof.Proofs[0] = forged
+	if err := verifyCommit(sec.Commit, p.PubKey(), Int64s{1}, commitProof, params); err != ErrIncorrectBranch {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectBranch, err)
+	}
+	commitProof = sec.ProveCommit(Int64s{3})
+	commitProof.ParentProofs[0][0] = shortBranchProof(sec, commitProof.ParentProofs[0][0].Idx)
+	if err := verifyCommit(sec.Commit, p.PubKey(), Int64s{3}, commitProof, params); err != ErrIncorrectBranch {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectBranch, err)
+	}
+}
+
+func TestSectors(t *testing.T) {
+	defer cleanup()
+	p, _ := newTestProver(0)
+	for id := 1; id < 4; id++ {
+		p.MustAddSector(id)
+	}
+	if _, err := p.AddSector(1); err != ErrSectorExists {
+		t.Fatalf("Expected err=%v; got err=%v", ErrSectorExists, err)
+	}
+	v := newTestVerifier(p)
+	for _, sec := range p.Sectors() {
+		if err := v.Register(sec.Commit, p.PubKey()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := v.VerifyCommit(sec.ProveCommitNI(seed1)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if num := v.NumRegistered(); num != 4 {
+		t.Fatalf("Expected 4 registered commits; got %d", num)
+	}
+	// Best sector has the highest quality
+	spaceProof, err := p.ProveSpaceNI(seed2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	best := Quality(spaceProof, spaceProof.Size)
+	for _, sec := range p.Sectors() {
+		if quality := Quality(sec.ProveSpaceNI(seed2), sec.Size()); quality > best {
+			t.Fatalf("Expected best space proof; sector %d has a higher quality", sec.Id)
+		}
+	}
+	if err = v.VerifySpace(spaceProof); err != nil {
+		t.Fatal(err.Error())
+	}
+	sec, err := p.Sector(spaceProof.Commit)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Proof names another registered commit
+	for _, other := range p.Sectors() {
+		if other != sec {
+			spaceProof.Commit = other.Commit
+			break
+		}
+	}
+	if err = v.VerifySpace(spaceProof); err == nil {
+		t.Fatal("Expected error for space proof naming another commit")
+	}
+	// Proof names an unregistered commit
+	spaceProof.Commit = make([]byte, len(sec.Commit))
+	if err = v.VerifySpace(spaceProof); err != ErrUnknownCommit {
+		t.Fatalf("Expected err=%v; got err=%v", ErrUnknownCommit, err)
+	}
+	spaceProof.Commit = sec.Commit
+	// Commit registered with another public key
+	other := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD + "!"))
+	if err = v.Register(sec.Commit, other); err != ErrCommitRegistered {
+		t.Fatalf("Expected err=%v; got err=%v", ErrCommitRegistered, err)
+	}
+	spaceProof.PubKey = other
+	if err = v.VerifySpace(spaceProof); err != ErrIncorrectPubKey {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectPubKey, err)
+	}
+	// Reopen a sector from its tree
+	for _, sec = range p.Sectors() {
+		if sec.Id == 2 {
+			sec.Close()
+		}
+	}
+	reopened := NewProver(p.Priv, p.Params())
+	sec, err = reopened.OpenSector(2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = p.Sector(sec.Commit); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = v.VerifySpace(sec.ProveSpaceNI(seed1)); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestPlot(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := p.Params()
+	path := PlotPath("plot", ID)
+	// The graph is not built in the open sector's leveldb
+	plot, err := CreatePlot(path, ID, p.PubKey(), params.Graph)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sec.Close()
+	if _, err = CreatePlot(path, ID, p.PubKey(), params.Graph); err != ErrPlotExists {
+		t.Fatalf("Expected err=%v; got err=%v", ErrPlotExists, err)
+	}
+	// and the temporary leveldb is removed
+	if infos, _ := ioutil.ReadDir("plot"); len(infos) != 1 {
+		t.Fatalf("Expected only the plot file; got %d files", len(infos))
+	}
+	header := plot.Header()
+	if err = plot.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Commit matches the leveldb sector
+	if !bytes.Equal(header.Commit, sec.Commit) {
+		t.Fatalf("Expected commit=%x; got commit=%x", sec.Commit, header.Commit)
+	}
+	// Plot can be moved
+	moved := PlotPath("plot", ID+1)
+	if err = os.Rename(path, moved); err != nil {
+		t.Fatal(err.Error())
+	}
+	headers, err := ListPlots("plot")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(headers) != 1 || !bytes.Equal(headers[0].Commit, header.Commit) {
+		t.Fatalf("Expected 1 plot with commit=%x", header.Commit)
+	}
+	if plot, err = OpenPlot(moved); err != nil {
+		t.Fatal(err.Error())
+	}
+	p = NewProver(p.Priv, params)
+	if sec, err = p.AddPlot(plot); err != nil {
+		t.Fatal(err.Error())
+	}
+	v := newTestVerifier(p)
+	v.Register(sec.Commit, p.PubKey())
+	if err = v.VerifyCommit(sec.ProveCommitNI(seed1)); err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceProof, err := p.ProveSpaceNI(seed2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = v.VerifySpace(spaceProof); err != nil {
+		t.Fatal(err.Error())
+	}
+	plot.Close()
+	// Plot labelled with another key
+	other := NewProver(tndr.GeneratePrivKey(PASSWORD+"!"), params)
+	plot, _ = OpenPlot(moved)
+	if _, err = other.AddPlot(plot); err != ErrIncorrectPubKey {
+		t.Fatalf("Expected err=%v; got err=%v", ErrIncorrectPubKey, err)
+	}
+	plot.Close()
+	// Corrupted and truncated plots
+	data, _ := ioutil.ReadFile(moved)
+	data[PLOT_HEADER_SIZE+header.NumLabels*HASH_SIZE] ^= 1
+	ioutil.WriteFile(moved, data, 0600)
+	if _, err = OpenPlot(moved); err != merkle.ErrRootMismatch {
+		t.Fatalf("Expected err=%v; got err=%v", merkle.ErrRootMismatch, err)
+	}
+	ioutil.WriteFile(moved, data[:len(data)-1], 0600)
+	if _, err = OpenPlot(moved); err != ErrPlotSize {
+		t.Fatalf("Expected err=%v; got err=%v", ErrPlotSize, err)
+	}
+	data[0] ^= 1
+	ioutil.WriteFile(moved, data, 0600)
+	if _, err = OpenPlot(moved); err != ErrPlotMagic {
+		t.Fatalf("Expected err=%v; got err=%v", ErrPlotMagic, err)
+	}
+}
+
+func TestPlotReopen(t *testing.T) {
+	defer cleanup()
+	// Stacked expanders have random edges, so parents
+	// must be read from the plot, not reconstructed
+	params := DefaultParams()
+	if testing.Short() {
+		spec := &graph.Spec{N: 64, K: 3, D: 5, Type: graph.STACKED_EXPANDERS}
+		params = NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+	}
+	priv := tndr.GeneratePrivKey(PASSWORD)
+	p := NewProver(priv, params)
+	path := PlotPath("plot", ID)
+	plot, err := CreatePlot(path, ID, p.PubKey(), params.Graph)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = plot.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	os.RemoveAll("Graph")
+	if plot, err = OpenPlot(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plot.Close()
+	sec, err := p.AddPlot(plot)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := NewVerifier(params)
+	v.Register(sec.Commit, p.PubKey())
+	if err = v.VerifyCommit(sec.ProveCommitNI(seed1)); err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceProof, err := p.ProveSpaceNI(seed2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = v.VerifySpace(spaceProof); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = plot.Parents(plot.Header().NumLabels); err != merkle.ErrInvalidIdx {
+		t.Fatalf("Expected err=%v; got err=%v", merkle.ErrInvalidIdx, err)
+	}
+}
+
+func TestPrecompute(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := p.Params()
+	expected := sec.ProveSpaceNI(seed1)
+	plot, err := CreatePlot(PlotPath("plot", ID+1), ID+1, p.PubKey(), params.Graph)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = p.CacheLevels(3); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Cache levels apply to sectors added later
+	other, err := p.AddPlot(plot)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p.Precompute(seed1)
+	if spaceProof := sec.ProveSpaceNI(seed1); !reflect.DeepEqual(spaceProof, expected) {
+		t.Fatal("Precomputed proof does not match proof")
+	}
+	if err = VerifySpaceProof(other.Commit, other.ProveSpaceNI(seed1), params); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Precomputed proofs are used once
+	sec.ProveSpaceNI(seed1)
+	stats := p.Stats()
+	if stats.Proofs.Hits != 2 || stats.Proofs.Misses != 2 {
+		t.Errorf("Expected hits=2, misses=2; got %v", stats.Proofs)
+	}
+	// Each proof reads 2 cached siblings, the sector
+	// proof before caching is not counted
+	beta := int64(params.Beta)
+	if stats.Nodes.Hits != 2*3*beta {
+		t.Errorf("Expected hits=%d; got %v", 2*3*beta, stats.Nodes)
+	}
+	if rate := stats.Nodes.HitRate(); rate <= 0 || rate >= 1 {
+		t.Errorf("Expected 0 < hit rate < 1; got rate=%f", rate)
+	}
+}
+
+func flipByte(t *testing.T, plot *Plot, offset int64) {
+	buf := make([]byte, 1)
+	if _, err := plot.file.ReadAt(buf, offset); err != nil {
+		t.Fatal(err.Error())
+	}
+	buf[0] ^= 0xff
+	if _, err := plot.file.WriteAt(buf, offset); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// Audits and repairs, then checks the plot is intact
+func repairPlot(t *testing.T, plot *Plot) *AuditReport {
+	report, err := AuditPlot(plot, 1, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Checked != plot.Header().NumLabels {
+		t.Fatalf("Expected %d labels checked; got %d", plot.Header().NumLabels, report.Checked)
+	}
+	if !report.Repaired {
+		t.Fatal("Expected plot to be repaired")
+	}
+	after, err := AuditPlot(plot, 1, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(after.Corrupted) > 0 || after.RootCorrupted {
+		t.Fatalf("Expected no corruption after repair; got %v", after)
+	}
+	return report
+}
+
+func TestAuditPlot(t *testing.T) {
+	specs := []*graph.Spec{
+		testParams().Graph,
+		{N: 64, K: 3, D: 5, Type: graph.STACKED_EXPANDERS},
+	}
+	for _, spec := range specs {
+		auditPlot(t, spec)
+		cleanup()
+	}
+}
+
+func auditPlot(t *testing.T, spec *graph.Spec) {
+	pub := tndr.PubKey(tndr.GeneratePrivKey(PASSWORD))
+	plot, err := CreatePlot(PlotPath("plot", ID), ID, pub, spec)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plot.Close()
+	if _, err = AuditPlot(plot, 0, false); err != ErrInvalidFraction {
+		t.Fatalf("Expected err=%v; got err=%v", ErrInvalidFraction, err)
+	}
+	report, err := AuditPlot(plot, 0.5, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Checked > plot.Header().NumLabels || len(report.Corrupted) > 0 {
+		t.Fatalf("Unexpected report for intact plot: %v", report)
+	}
+	// Corrupted labels, a sibling label is in the proof
+	for _, idx := range []int64{20, 21, 22, 100} {
+		flipByte(t, plot, plot.labels.leafOffset(idx))
+	}
+	report = repairPlot(t, plot)
+	if expected := []*Range{{20, 24}, {100, 102}}; !reflect.DeepEqual(report.Corrupted, expected) {
+		t.Fatalf("Expected corrupted=%v; got %v", expected, report.Corrupted)
+	}
+	// Corrupted merkle node
+	numNodes := plot.Header().NumNodes
+	flipByte(t, plot, plot.labels.nodeOffset((numNodes+1)>>2+3))
+	if report = repairPlot(t, plot); len(report.Corrupted) == 0 {
+		t.Fatal("Expected labels below corrupted node to be reported")
+	}
+	// Corrupted root
+	flipByte(t, plot, plot.labels.nodeOffset(1))
+	if report = repairPlot(t, plot); !report.RootCorrupted || len(report.Corrupted) > 0 {
+		t.Fatalf("Expected only root to be corrupted; got %v", report)
+	}
+	// Failed repair leaves the plot untouched
+	before, _ := ioutil.ReadFile(plot.Path())
+	commit := plot.header.Commit
+	plot.header.Commit = make([]byte, HASH_SIZE)
+	if _, err = AuditPlot(plot, 1, true); err != ErrRepairFailed {
+		t.Fatalf("Expected err=%v; got err=%v", ErrRepairFailed, err)
+	}
+	plot.header.Commit = commit
+	if after, _ := ioutil.ReadFile(plot.Path()); !bytes.Equal(after, before) {
+		t.Fatal("Expected failed repair not to write to the plot")
+	}
+}
+
+func TestReplica(t *testing.T) {
+	defer cleanup()
+	priv := tndr.GeneratePrivKey(PASSWORD)
+	if _, err := CreateReplica(PlotPath("plot", ID), ID, tndr.PubKey(priv), testParams().Graph, []byte{1}); err != ErrReplicaSpec {
+		t.Fatalf("Expected err=%v; got err=%v", ErrReplicaSpec, err)
+	}
+	spec := &graph.Spec{N: 64, K: 3, D: 5, Type: graph.STACKED_EXPANDERS}
+	params := NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+	capacity := ReplicaCapacity(params.Graph)
+	if _, err := CreateReplica(PlotPath("plot", ID), ID, tndr.PubKey(priv), params.Graph, make([]byte, capacity+1)); err != ErrDataSize {
+		t.Fatalf("Expected err=%v; got err=%v", ErrDataSize, err)
+	}
+	data := make([]byte, capacity-5)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	plot, err := CreateReplica(PlotPath("plot", ID), ID, tndr.PubKey(priv), params.Graph, data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	header := plot.Header()
+	plot.Close()
+	if plot, err = OpenPlot(plot.Path()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plot.Close()
+	if !plot.IsReplica() {
+		t.Fatal("Expected plot to be a replica")
+	}
+	decoded, err := plot.Decode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("Decoded data does not match original data")
+	}
+	// Encoded chunks are not the data
+	encoded, _ := plot.EncodedChunk(0)
+	if bytes.Equal(encoded, data[:HASH_SIZE]) {
+		t.Fatal("Expected chunk to be encoded")
+	}
+	replicaProof, err := plot.ProveReplicaNI(seed1, params)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifyReplicaProof(header.Commit, header.ReplicaCommit, header.NumChunks, replicaProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	challenges := DeriveChallenges(header.ReplicaCommit, header.PubKey, seed1, params.Beta, header.NumChunks)
+	for i, chunk := range replicaProof.Chunks() {
+		begin := challenges[i] * HASH_SIZE
+		if !bytes.Equal(chunk[:5], data[begin:begin+5]) {
+			t.Fatalf("Expected proof chunk %d to decode to data", i)
+		}
+	}
+	// Fewer chunks than committed
+	if err = VerifyReplicaProof(header.Commit, header.ReplicaCommit, header.NumChunks-1, replicaProof, params); err == nil {
+		t.Fatal("Expected error for replica proof with wrong number of chunks")
+	}
+	// Tampered encoded chunk
+	replicaProof.ChunkProofs[0].Value[0] ^= 1
+	if err = VerifyReplicaProof(header.Commit, header.ReplicaCommit, header.NumChunks, replicaProof, params); err != ErrNotVerified {
+		t.Fatalf("Expected err=%v; got err=%v", ErrNotVerified, err)
+	}
+	// Encoded chunks are stored in place of labels,
+	// which are recomputed for commit and space proofs
+	label, _ := plot.Label(header.chunkLabel(0))
+	if bytes.Equal(label, encoded) {
+		t.Fatal("Expected label slot to hold the encoded chunk")
+	}
+	p := NewProver(priv, params)
+	sec, err := p.AddPlot(plot)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifyCommitProof(header.Commit, sec.ProveCommitNI(seed1), params); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifySpaceProof(header.Commit, sec.ProveSpaceNI(seed2), params); err != nil {
+		t.Fatal(err.Error())
+	}
+	if report, err := AuditPlot(plot, 1, false); err != nil || len(report.Corrupted) > 0 {
+		t.Fatalf("Expected intact replica; got report=%v, err=%v", report, err)
+	}
+	// Repair hashes recomputed labels of encoded slots
+	// without writing them over the chunks
+	first := header.chunkLabel(0)
+	flipByte(t, plot, plot.labels.nodeOffset((first+header.NumNodes+1)>>1))
+	if report := repairPlot(t, plot); len(report.Corrupted) == 0 {
+		t.Fatal("Expected labels below corrupted node to be reported")
+	}
+	if decoded, err = plot.Decode(); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatal("Expected repair to keep the encoded chunks")
+	}
+	// Corrupted chunks are reported in pairs, not repaired
+	flipByte(t, plot, plot.replica.leafOffset(1))
+	report, err := AuditPlot(plot, 1, true)
+	if err != ErrChunksCorrupted {
+		t.Fatalf("Expected err=%v; got err=%v", ErrChunksCorrupted, err)
+	}
+	if expected := []*Range{{0, 2}}; len(report.Corrupted) > 0 || !reflect.DeepEqual(report.CorruptedChunks, expected) {
+		t.Fatalf("Expected corrupted chunks=%v; got %v", expected, report)
+	}
+	flipByte(t, plot, plot.replica.leafOffset(1))
+	if decoded, err = plot.Decode(); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatal("Expected chunks to decode to data")
+	}
+	// Dropping the encoded chunks breaks replica proofs
+	zero := make([]byte, HASH_SIZE)
+	for i := int64(0); i < header.NumChunks; i++ {
+		plot.file.WriteAt(zero, plot.replica.leafOffset(i))
+	}
+	if replicaProof, err = plot.ProveReplicaNI(seed1, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifyReplicaProof(header.Commit, header.ReplicaCommit, header.NumChunks, replicaProof, params); err != ErrNotVerified {
+		t.Fatalf("Expected err=%v; got err=%v", ErrNotVerified, err)
+	}
+	// Plain plots are not replicas
+	plain, err := CreatePlot(PlotPath("plot", ID+1), ID+1, tndr.PubKey(priv), params.Graph)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plain.Close()
+	if _, err = plain.Decode(); err != ErrNotReplica {
+		t.Fatalf("Expected err=%v; got err=%v", ErrNotReplica, err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	v := newTestVerifier(p)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	s, _ := v.NewSession(sec.Commit, p.PubKey())
+	challenges, _ := s.CommitChallenges(seed1)
+	if err := s.VerifyCommit(sec.ProveCommit(challenges)); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Response after the deadline
+	challenges, _ = s.SpaceChallenges(seed1)
+	if issued := s.Issued(); !issued.Equal(now) {
+		t.Fatalf("Expected issued=%v; got issued=%v", now, issued)
+	}
+	now = now.Add(v.Params().Deadline + time.Millisecond)
+	err := s.VerifySpace(sec.ProveSpace(challenges))
+	if _, ok := err.(*ErrDeadlineExceeded); !ok {
+		t.Fatalf("Expected deadline exceeded; got err=%v", err)
+	}
+	if state := s.State(); state != COMMIT_VERIFIED {
+		t.Fatalf("Expected state=%v; got state=%v", COMMIT_VERIFIED, state)
+	}
+	// Response before the deadline
+	challenges, _ = s.SpaceChallenges(seed2)
+	now = now.Add(v.Params().Deadline)
+	if err = s.VerifySpace(sec.ProveSpace(challenges)); err != nil {
+		t.Fatal(err.Error())
+	}
+	// No deadline
+	v.Params().Deadline = 0
+	challenges, _ = s.SpaceChallenges(seed1)
+	now = now.Add(time.Hour)
+	if err = s.VerifySpace(sec.ProveSpace(challenges)); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// Honest response latency vs. time to relabel the graph,
+// the deadline should fall between the two
+func BenchmarkDeadline(b *testing.B) {
+	defer cleanup()
+	specs := []*graph.Spec{
+		graph.DefaultSpec(graph.DOUBLE_BUTTERFLY),
+		&graph.Spec{N: 6, K: 4, Type: graph.DOUBLE_BUTTERFLY},
+	}
+	for i, spec := range specs {
+		params := NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+		p := NewProver(tndr.GeneratePrivKey(PASSWORD), params)
+		sec := p.MustAddSector(i)
+		v := NewVerifier(params)
+		s, _ := v.NewSession(sec.Commit, p.PubKey())
+		s.state = COMMIT_VERIFIED
+		b.Run(Sprintf("response/size=%d", spec.Size()), func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				challenges, _ := s.SpaceChallenges(seed1)
+				if err := s.VerifySpace(sec.ProveSpace(challenges)); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+		g := sec.store.(*dbStore).graph
+		b.Run(Sprintf("relabel/size=%d", spec.Size()), func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				g.SetValues(p.PubKey())
+			}
+		})
+	}
+}
+
+// Space proof whose digest depends only on the seed
+func seededProof(seed int) *SpaceProof {
+	value := Sum32(Int64Bytes(int64(seed)))
+	return &SpaceProof{Proofs: []*merkle.Proof{{Value: value}}}
+}
+
+func TestQuality(t *testing.T) {
+	// Lower digest has higher quality
+	low, high := seededProof(0), seededProof(0)
+	for i := 1; i <= 100; i++ {
+		spaceProof := seededProof(i)
+		if bytes.Compare(spaceProof.Digest(), low.Digest()) < 0 {
+			low = spaceProof
+		} else if bytes.Compare(spaceProof.Digest(), high.Digest()) > 0 {
+			high = spaceProof
+		}
+	}
+	if Quality(low, 1024) <= Quality(high, 1024) {
+		t.Error("Expected lower digest to have higher quality")
+	}
+	// Finite and distinct for large spaces
+	for _, size := range []int64{1, 1 << 20, 1 << 40, 1 << 62} {
+		q1, q2 := Quality(low, size), Quality(high, size)
+		if math.IsInf(q1, 0) || math.IsNaN(q1) || q1 >= 0 || q1 <= q2 {
+			t.Errorf("Expected %f > %f for size=%d", q1, q2, size)
+		}
+	}
+	// A space of N labels beats one of M labels
+	// with probability N/(N+M)
+	numSeeds := 20000
+	sizes := [][2]int64{{1 << 16, 1 << 16}, {1 << 16, 3 << 16}, {1 << 20, 1 << 24}}
+	for _, size := range sizes {
+		wins := 0
+		for seed := 0; seed < numSeeds; seed++ {
+			q1 := Quality(seededProof(2*seed), size[0])
+			q2 := Quality(seededProof(2*seed+1), size[1])
+			if q2 > q1 {
+				wins++
+			}
+		}
+		expected := float64(size[1]) / float64(size[0]+size[1])
+		if rate := float64(wins) / float64(numSeeds); math.Abs(rate-expected) > 0.02 {
+			t.Errorf("Expected larger space to win with rate=%f; got rate=%f", expected, rate)
+		}
+	}
+}
+
+func TestProofCodec(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	params := p.Params()
+	commitData, err := sec.ProveCommitNI(seed1).MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	commitProof := new(CommitProof)
+	if err = commitProof.UnmarshalBinary(commitData); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifyCommitProof(sec.Commit, commitProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceData, err := sec.ProveSpaceNI(seed2).MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	spaceProof := new(SpaceProof)
+	if err = spaceProof.UnmarshalBinary(spaceData); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifySpaceProof(sec.Commit, spaceProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Wrong type
+	if err = spaceProof.UnmarshalBinary(commitData); err != ErrInvalidEncoding {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidEncoding, err)
+	}
+	// Trailing bytes
+	if err = commitProof.UnmarshalBinary(append(commitData, 0)); err != ErrInvalidEncoding {
+		t.Errorf("Expected err=%v; got err=%v", ErrInvalidEncoding, err)
+	}
+	// Oversized input is rejected before decoding
+	if err = spaceProof.UnmarshalBinary(make([]byte, MAX_SPACE_PROOF_SIZE+1)); err != ErrProofTooLarge {
+		t.Errorf("Expected err=%v; got err=%v", ErrProofTooLarge, err)
+	}
+	// Decoding against the params
+	if commitProof, err = DecodeCommitProof(commitData, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = VerifyCommitProof(sec.Commit, commitProof, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	if spaceProof, err = DecodeSpaceProof(spaceData, params); err != nil {
+		t.Fatal(err.Error())
+	}
+	fewer, smaller := *params, *params
+	fewer.Beta--
+	smaller.SeedSize--
+	for _, params := range []*Params{&fewer, &smaller} {
+		if _, err = DecodeSpaceProof(spaceData, params); err != ErrProofTooLarge {
+			t.Errorf("Expected err=%v; got err=%v", ErrProofTooLarge, err)
+		}
+	}
+	// Short branches decode only without params
+	spaceProof.Proofs[0] = shortBranchProof(sec, 1)
+	if spaceData, err = spaceProof.MarshalBinary(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = new(SpaceProof).UnmarshalBinary(spaceData); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = DecodeSpaceProof(spaceData, params); err != ErrIncorrectBranch {
+		t.Errorf("Expected err=%v; got err=%v", ErrIncorrectBranch, err)
+	}
+	// Parents beyond the graph in-degree
+	commitProof.ParentProofs[0] = append(commitProof.ParentProofs[0], commitProof.Proofs[0], commitProof.Proofs[0], commitProof.Proofs[0], commitProof.Proofs[0])
+	if commitData, err = commitProof.MarshalBinary(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = DecodeCommitProof(commitData, params); err != ErrProofTooLarge {
+		t.Errorf("Expected err=%v; got err=%v", ErrProofTooLarge, err)
+	}
+	// Too many challenges
+	spaceProof.Proofs = make([]*merkle.Proof, MAX_NUM_CHALLENGES+1)
+	if _, err = spaceProof.MarshalBinary(); err != ErrProofTooLarge {
+		t.Errorf("Expected err=%v; got err=%v", ErrProofTooLarge, err)
+	}
+}
+
+func TestBatchVerifier(t *testing.T) {
+	defer cleanup()
+	p, sec := newTestProver(ID)
+	other := p.MustAddSector(ID + 1)
+	params := p.Params()
+	bv := NewBatchVerifier(params, 4)
+	var commits [][]byte
+	var proofs []*SpaceProof
+	add := func(commit []byte, spaceProof *SpaceProof) {
+		if idx := bv.Add(commit, spaceProof); idx != len(proofs) {
+			t.Fatalf("Expected idx=%d; got idx=%d", len(proofs), idx)
+		}
+		commits = append(commits, commit)
+		proofs = append(proofs, spaceProof)
+	}
+	for i := byte(0); i < 8; i++ {
+		seed := make([]byte, DEFAULT_SEED_SIZE)
+		seed[0] = i
+		add(sec.Commit, sec.ProveSpaceNI(seed))
+		add(other.Commit, other.ProveSpaceNI(seed))
+	}
+	// Duplicate
+	add(sec.Commit, proofs[0])
+	// Tampered value, copied so the original is unchanged
+	data, _ := proofs[2].MarshalBinary()
+	tampered := new(SpaceProof)
+	tampered.UnmarshalBinary(data)
+	tampered.Proofs[0].Value[0] ^= 1
+	add(sec.Commit, tampered)
+	// Wrong commit
+	add(other.Commit, proofs[4])
+	add(sec.Commit, nil)
+	results := bv.Verify()
+	if len(results) != bv.Len() {
+		t.Fatalf("Expected %d results; got %d", bv.Len(), len(results))
+	}
+	for i, err := range results {
+		var expected error = ErrNotVerified
+		if proofs[i] != nil {
+			expected = VerifySpaceProof(commits[i], proofs[i], params)
+		}
+		if err != expected {
+			t.Errorf("Proof %d: expected err=%v; got err=%v", i, expected, err)
+		}
+	}
+	if results[0] != nil || results[len(results)-3] == nil || results[len(results)-2] == nil {
+		t.Errorf("Unexpected results %v", results)
+	}
+	// At most BATCH_CACHE_LEVELS levels per commit
+	if n := bv.nodes.len(); n == 0 || n >= 2<<BATCH_CACHE_LEVELS {
+		t.Errorf("Expected 0 < cached nodes < %d; got %d", 2<<BATCH_CACHE_LEVELS, n)
+	}
+	// Short branches do not end at cached nodes
+	if forged := shortBranchProof(sec, 1); bv.nodes.verifyProof(forged, sec.Commit) {
+		t.Error("Expected proof with short branch not to verify")
+	}
+	bv.Reset()
+	if n := bv.nodes.len(); n != 0 {
+		t.Errorf("Expected no cached nodes after reset; got %d", n)
+	}
+	// Cached nodes do not verify a tampered proof
+	bv.Add(sec.Commit, proofs[0])
+	bv.Add(sec.Commit, tampered)
+	if results = bv.Verify(); len(results) != 2 || results[0] != nil || results[1] != ErrNotVerified {
+		t.Errorf("Expected err=%v; got results=%v", ErrNotVerified, results)
+	}
+}
+
+func fuzzCanonical(t *testing.T, data []byte, proof interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary([]byte) error
+}) {
+	if err := proof.UnmarshalBinary(data); err != nil {
+		return
+	}
+	encoded, err := proof.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(encoded, data) {
+		t.Fatal("Encoding is not canonical")
+	}
+}
+
+// Fuzz workers run in separate processes, so seeds are built
+// without a sector since they would share the same database
+
+func fuzzMerkleProof(idx int64) *merkle.Proof {
+	return &merkle.Proof{
+		Branch: [][]byte{make([]byte, HASH_SIZE), make([]byte, HASH_SIZE)},
+		Idx:    idx,
+		Pos:    idx + 4,
+		Value:  make([]byte, HASH_SIZE),
+	}
+}
+
+func FuzzCommitProof(f *testing.F) {
+	commitProof := &CommitProof{
+		Commit:       make([]byte, HASH_SIZE),
+		Id:           ID,
+		ParentProofs: [][]*merkle.Proof{nil, {fuzzMerkleProof(0), fuzzMerkleProof(1)}},
+		Proofs:       []*merkle.Proof{fuzzMerkleProof(0), fuzzMerkleProof(2)},
+		Seed:         seed1,
+		Size:         4,
+	}
+	data, err := commitProof.MarshalBinary()
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzCanonical(t, data, new(CommitProof))
+	})
+}
+
+func FuzzSpaceProof(f *testing.F) {
+	spaceProof := &SpaceProof{
+		Commit: make([]byte, HASH_SIZE),
+		Proofs: []*merkle.Proof{fuzzMerkleProof(1), fuzzMerkleProof(3)},
+		Seed:   seed2,
+		Size:   4,
+	}
+	data, err := spaceProof.MarshalBinary()
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzCanonical(t, data, new(SpaceProof))
+	})
+}
+
+func TestParams(t *testing.T) {
+	if num := NumChallenges(DEFAULT_SOUNDNESS, DEFAULT_FRACTION); num != 16 {
+		t.Errorf("Expected 16 challenges; got %d", num)
+	}
+	if num := NumChallenges(1e-6, 0.9); num != 132 {
+		t.Errorf("Expected 132 challenges; got %d", num)
+	}
+	params := DefaultParams()
+	if size := params.GraphSize(); size != 65536 {
+		t.Errorf("Expected graph size=65536; got size=%d", size)
+	}
+	specs := []*graph.Spec{
+		graph.DefaultSpec(graph.DOUBLE_BUTTERFLY),
+		&graph.Spec{N: 64, K: 3, D: 5, Type: graph.STACKED_EXPANDERS},
+		&graph.Spec{N: 64, K: 3, D: 4, Type: graph.LINEAR_SUPER_CONCENTRATOR},
+	}
+	defer cleanup()
+	for _, spec := range specs {
+		g := graph.Construct(ID, spec)
+		if g.Size() != spec.Size() {
+			t.Errorf("Expected %s size=%d; got size=%d", spec.Type, spec.Size(), g.Size())
+		}
+		if fixed := spec.Type != graph.LINEAR_SUPER_CONCENTRATOR; spec.FixedInDegree() != fixed {
+			t.Fatalf("Expected %s fixed in-degree=%v", spec.Type, fixed)
+		} else if !fixed {
+			// In-degree depends on the random expander edges
+			g.Close()
+			continue
+		}
+		for idx := int64(0); idx < g.Size(); idx++ {
+			inDegree, ok := spec.InDegree(idx)
+			if numParents := int64(len(g.GetParents(idx))); !ok || numParents != inDegree {
+				t.Fatalf("Expected %s idx=%d to have %d parents; got %d parents", spec.Type, idx, inDegree, numParents)
+			}
+		}
+		g.Close()
+	}
+}
+
+func TestUnfixedInDegree(t *testing.T) {
+	defer cleanup()
+	spec := &graph.Spec{N: 64, K: 3, D: 5, Localize: true, Type: graph.STACKED_EXPANDERS}
+	params := NewParams(spec, DEFAULT_SOUNDNESS, DEFAULT_FRACTION)
+	p := NewProver(tndr.GeneratePrivKey(PASSWORD), params)
+	sec := p.MustAddSector(ID)
+	defer sec.Close()
+	commitProof := sec.ProveCommitNI(seed1)
+	if err := VerifyCommitProof(sec.Commit, commitProof, params); err != ErrInDegree {
+		t.Fatalf("Expected err=%v; got err=%v", ErrInDegree, err)
+	}
+	data, err := commitProof.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = DecodeCommitProof(data, params); err != ErrInDegree {
+		t.Fatalf("Expected err=%v; got err=%v", ErrInDegree, err)
+	}
+	// Space proofs do not include parents
+	if err = VerifySpaceProof(sec.Commit, sec.ProveSpaceNI(seed2), params); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -1,14 +1,24 @@
 package protocol
 
 import (
+	"bytes"
 	"github.com/tendermint/go-crypto"
 	"github.com/zbo14/pos/crypto/tndr"
 	"github.com/zbo14/pos/graph"
 	"github.com/zbo14/pos/merkle"
 	. "github.com/zbo14/pos/util"
+	"runtime"
+	"sync"
 )
 
+// Proofs name the commitment of the sector they were computed
+// against, so a verifier can look up the registered commitment
+// Commit proofs also carry the sector id, which is labelled into
+// the graph values
+
 type CommitProof struct {
+	Commit       []byte               `json:"commit"`
+	Id           int                  `json:"id"`
 	ParentProofs [][]*merkle.Proof    `json:"parent_proofs"`
 	Proofs       []*merkle.Proof      `json:"proofs"`
 	PubKey       crypto.PubKeyEd25519 `json:"public_key"`
@@ -17,22 +27,33 @@ type CommitProof struct {
 }
 
 type SpaceProof struct {
+	Commit []byte               `json:"commit"`
 	Proofs []*merkle.Proof      `json:"proofs"`
 	PubKey crypto.PubKeyEd25519 `json:"public_key"`
 	Seed   []byte               `json:"seed"`
 	Size   int64                `json:"size"`
 }
 
+var (
+	ErrNoSectors      = Error("Prover has no sectors")
+	ErrSectorExists   = Error("Sector with id already exists")
+	ErrSectorNotFound = Error("Sector not found")
+)
+
+// Prover manages independent sectors,
+// all of which share the prover's key and params
+
 type Prover struct {
-	Commit []byte //merkle root hash
-	graph  *graph.Graph
-	Priv   crypto.PrivKeyEd25519
-	tree   *merkle.Tree
+	cacheLevels int
+	params      *Params
+	Priv        crypto.PrivKeyEd25519
+	sectors     []*Sector
 }
 
-func NewProver(priv crypto.PrivKeyEd25519) *Prover {
+func NewProver(priv crypto.PrivKeyEd25519, params *Params) *Prover {
 	return &Prover{
-		Priv: priv,
+		params: params,
+		Priv:   priv,
 	}
 }
 
@@ -40,111 +61,176 @@ func (p *Prover) PubKey() crypto.PubKeyEd25519 {
 	return tndr.PubKey(p.Priv)
 }
 
-func (p *Prover) MerkleTree(id int) {
-	p.tree = merkle.NewTree(id)
+func (p *Prover) Params() *Params {
+	return p.params
 }
 
-func (p *Prover) Graph(id int, _type string) {
-	switch _type {
-	case graph.DOUBLE_BUTTERFLY:
-		p.graph = graph.DefaultDoubleButterfly(id)
-	case graph.LINEAR_SUPER_CONCENTRATOR:
-		p.graph = graph.DefaultLinearSuperConcentrator(id)
-	case graph.STACKED_EXPANDERS:
-		p.graph = graph.DefaultStackedExpanders(id)
-	default:
-		Panicf("Unexpected graph type: %s\n", _type)
-	}
+func (p *Prover) Sectors() []*Sector {
+	return p.sectors
 }
 
-func (p *Prover) GraphDoubleButterfly(id int) {
-	p.Graph(id, graph.DOUBLE_BUTTERFLY)
+func (p *Prover) NumSectors() int {
+	return len(p.sectors)
 }
 
-func (p *Prover) GraphLinearSuperConcentrator(id int) {
-	p.Graph(id, graph.LINEAR_SUPER_CONCENTRATOR)
+// Sector with the given commitment
+func (p *Prover) Sector(commit []byte) (*Sector, error) {
+	for _, s := range p.sectors {
+		if bytes.Equal(s.Commit, commit) {
+			return s, nil
+		}
+	}
+	return nil, ErrSectorNotFound
 }
 
-func (p *Prover) GraphStackedExpanders(id int) {
-	p.Graph(id, graph.STACKED_EXPANDERS)
+// Caches the top levels of every sector's merkle tree,
+// including sectors added later
+func (p *Prover) CacheLevels(levels int) error {
+	for _, s := range p.sectors {
+		if err := s.CacheLevels(levels); err != nil {
+			return err
+		}
+	}
+	p.cacheLevels = levels
+	return nil
 }
 
-func (p *Prover) MakeCommit() {
-	pub := p.PubKey()
-	p.graph.SetValues(pub)
-	numLeaves := p.graph.Size()
-	p.tree.Init(numLeaves)
-	var idx int64
-	for ; idx < numLeaves; idx++ {
-		nd := p.graph.Get(idx)
-		if !p.tree.AddLeaf(nd.Value) {
-			panic("Could not add leaf")
+func (p *Prover) addSector(s *Sector) (*Sector, error) {
+	if p.cacheLevels > 0 {
+		if err := s.CacheLevels(p.cacheLevels); err != nil {
+			s.Close()
+			return nil, err
 		}
 	}
-	p.tree.HashLevels()
-	p.Commit = p.tree.Root()
-}
-
-func (p *Prover) NewCommitProof(parentProofs [][]*merkle.Proof, proofs []*merkle.Proof) *CommitProof {
-	pub := p.PubKey()
-	size := p.graph.Size()
-	return &CommitProof{
-		ParentProofs: parentProofs,
-		Proofs:       proofs,
-		PubKey:       pub,
-		Size:         size,
-	}
-}
-
-func (p *Prover) ProveCommit(challenges []int64) *CommitProof {
-	if p.graph == nil {
-		panic("Graph is not set")
-	}
-	if p.tree == nil {
-		panic("Tree is not set")
-	}
-	var parents Int64s
-	proofs := make([]*merkle.Proof, len(challenges))
-	parentProofs := make([][]*merkle.Proof, len(challenges))
-	for i, c := range challenges {
-		sibling := p.graph.Get(c ^ 1)
-		nd := p.graph.Get(c)
-		proofs[i] = p.tree.ComputeProof(c, sibling.Value, nd.Value)
-		parents = p.graph.GetParents(c)
-		if len(parents) > 0 {
-			parentProofs[i] = make([]*merkle.Proof, len(parents))
-			for j, parent := range parents { //should be sorted
-				sibling = p.graph.Get(parent ^ 1)
-				nd = p.graph.Get(parent)
-				parentProofs[i][j] = p.tree.ComputeProof(parent, sibling.Value, nd.Value)
-			}
+	p.sectors = append(p.sectors, s)
+	return s, nil
+}
+
+func (p *Prover) hasSector(id int) bool {
+	for _, s := range p.sectors {
+		if s.Id == id {
+			return true
 		}
 	}
-	return p.NewCommitProof(parentProofs, proofs)
+	return false
+}
+
+// Constructs a graph from the graph spec in params,
+// then labels it and commits to it in a new tree
+func (p *Prover) AddSector(id int) (*Sector, error) {
+	if p.hasSector(id) {
+		return nil, ErrSectorExists
+	}
+	db := &dbStore{
+		graph: graph.Construct(id, p.params.Graph),
+		tree:  merkle.NewTree(id),
+	}
+	s := &Sector{
+		Commit: db.makeCommit(p.PubKey(), runtime.NumCPU()),
+		Id:     id,
+		params: p.params,
+		pub:    p.PubKey(),
+		store:  db,
+	}
+	return p.addSector(s)
 }
 
-func (p *Prover) NewSpaceProof(proofs []*merkle.Proof) *SpaceProof {
-	pub := p.PubKey()
-	size := p.graph.Size()
-	return &SpaceProof{
-		Proofs: proofs,
-		PubKey: pub,
-		Size:   size,
+func (p *Prover) MustAddSector(id int) *Sector {
+	s, err := p.AddSector(id)
+	Check(err)
+	return s
+}
+
+// Reopens a sector from a previous commit
+func (p *Prover) OpenSector(id int) (*Sector, error) {
+	if p.hasSector(id) {
+		return nil, ErrSectorExists
+	}
+	tree, err := merkle.OpenTree(merkle.TreePath(id))
+	if err != nil {
+		return nil, err
+	}
+	spec := p.params.Graph
+	if tree.NumLeaves() != spec.Size() {
+		tree.Close()
+		return nil, ErrIncorrectSize
+	}
+	s := &Sector{
+		Commit: tree.Root(),
+		Id:     id,
+		params: p.params,
+		pub:    p.PubKey(),
+		store: &dbStore{
+			graph: graph.NewGraph(id, spec.Size(), spec.Type),
+			tree:  tree,
+		},
+	}
+	return p.addSector(s)
+}
+
+// Adds a sector kept in a plot file
+// The plot must be labelled with our key and the graph spec in params
+func (p *Prover) AddPlot(plot *Plot) (*Sector, error) {
+	header := plot.Header()
+	if header.PubKey != p.PubKey() {
+		return nil, ErrIncorrectPubKey
+	} else if *header.Graph != *p.params.Graph {
+		return nil, ErrPlotHeader
+	} else if p.hasSector(header.Id) {
+		return nil, ErrSectorExists
 	}
+	s := &Sector{
+		Commit: header.Commit,
+		Id:     header.Id,
+		params: p.params,
+		pub:    header.PubKey,
+		store:  plot,
+	}
+	return p.addSector(s)
+}
+
+// Proves space with every sector and
+// returns the proof with the highest quality
+func (p *Prover) ProveSpaceNI(seed []byte) (*SpaceProof, error) {
+	var best *SpaceProof
+	var bestQuality float64
+	for _, s := range p.sectors {
+		spaceProof := s.ProveSpaceNI(seed)
+		quality := Quality(spaceProof, spaceProof.Size)
+		if best == nil || quality > bestQuality {
+			best, bestQuality = spaceProof, quality
+		}
+	}
+	if best == nil {
+		return nil, ErrNoSectors
+	}
+	return best, nil
 }
 
-func (p *Prover) ProveSpace(challenges []int64) *SpaceProof {
-	if p.graph == nil {
-		panic("Graph is not set")
+// Precomputes space proofs for the seed in every sector,
+// so ProveSpaceNI with the seed does not read the sectors
+func (p *Prover) Precompute(seed []byte) {
+	var wg sync.WaitGroup
+	for _, s := range p.sectors {
+		wg.Add(1)
+		go func(s *Sector) {
+			defer wg.Done()
+			s.PrecomputeSpace(seed)
+		}(s)
 	}
-	if p.tree == nil {
-		panic("Tree is not set")
+	wg.Wait()
+}
+
+// Stats summed over sectors
+func (p *Prover) Stats() *ProverStats {
+	stats := &ProverStats{
+		Nodes:  new(merkle.CacheStats),
+		Proofs: new(merkle.CacheStats),
 	}
-	proofs := make([]*merkle.Proof, len(challenges))
-	for i, c := range challenges {
-		sibling := p.graph.Get(c ^ 1)
-		nd := p.graph.Get(c)
-		proofs[i] = p.tree.ComputeProof(c, sibling.Value, nd.Value)
+	for _, s := range p.sectors {
+		sectorStats := s.Stats()
+		stats.Nodes.Add(sectorStats.Nodes)
+		stats.Proofs.Add(sectorStats.Proofs)
 	}
-	return p.NewSpaceProof(proofs)
+	return stats
 }
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"encoding/binary"
+	. "github.com/zbo14/pos/util"
+	"math"
+)
+
+// Proof quality from Spacemint
+// The digest of a proof is read as u in (0, 1), lower is better.
+// A proof from a space of N labels has quality (1-u)^(1/N), which
+// is distributed as the max of N uniform values, so a space of N
+// labels beats a space of M labels with probability N/(N+M).
+// The log of the quality, log(1-u)/N, is returned since the
+// quality itself rounds to 1 for realistic space sizes.
+
+type Digester interface {
+	Digest() []byte
+}
+
+// Digest of the values in a space proof
+func (spaceProof *SpaceProof) Digest() []byte {
+	hash := NewHash()
+	for _, p := range spaceProof.Proofs {
+		hash.Write(p.Value)
+	}
+	return hash.Sum(nil)
+}
+
+// Digest of the values in a commit proof
+func (commitProof *CommitProof) Digest() []byte {
+	hash := NewHash()
+	for _, p := range commitProof.Proofs {
+		hash.Write(p.Value)
+	}
+	return hash.Sum(nil)
+}
+
+// Log quality of a proof, higher is better and 0 is the max
+func Quality(proof Digester, spaceSize int64) float64 {
+	if spaceSize < 1 {
+		Panicf("Expected space size > 0; got size=%d", spaceSize)
+	}
+	u := digestFraction(proof.Digest())
+	return math.Log1p(-u) / float64(spaceSize)
+}
+
+// Top 53 bits of the digest as a float in (0, 1)
+func digestFraction(digest []byte) float64 {
+	bits := binary.BigEndian.Uint64(digest[:8]) >> 11
+	return (float64(bits) + 0.5) / (1 << 53)
+}
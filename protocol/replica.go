@@ -0,0 +1,262 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/graph"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"os"
+)
+
+// Replication mode
+// User data is split into HASH_SIZE chunks, chunk i is
+// encoded by XOR with label i of the last graph layer.
+// The encoded chunk is stored in place of the label, so
+// the space in a replica plot stores the user's data.
+// The prover recomputes last layer labels from their
+// parents when they are needed, so no label may have a
+// last layer parent. That holds for stacked expanders and
+// linear superconcentrators, but the last row of a double
+// butterfly is a chain of sequential edges, so replicas
+// with that graph are rejected. The encoded chunks are
+// committed in a second merkle tree, whose nodes follow
+// the parents section.
+// Labels of the last layer depend on the prover's key and
+// sector id, so each replica of the same data is unique.
+
+var (
+	ErrDataSize    = Error("Data is empty or larger than replica capacity")
+	ErrNotReplica  = Error("Plot is not a replica")
+	ErrReplicaSpec = Error("Graph has last layer labels with last layer parents")
+)
+
+// Whether no label in the graph has a last layer parent
+func replicaSpec(spec *graph.Spec) bool {
+	return spec.Type != graph.DOUBLE_BUTTERFLY
+}
+
+// Max bytes of data a replica with the graph spec holds
+func ReplicaCapacity(spec *graph.Spec) int64 {
+	return spec.LastLayerSize() * HASH_SIZE
+}
+
+func numChunks(dataSize int64) int64 {
+	return (dataSize + HASH_SIZE - 1) / HASH_SIZE
+}
+
+func EncodeChunk(chunk, label []byte) []byte {
+	encoded := make([]byte, HASH_SIZE)
+	for i := range encoded {
+		encoded[i] = chunk[i] ^ label[i]
+	}
+	return encoded
+}
+
+// XOR is its own inverse
+func DecodeChunk(encoded, label []byte) []byte {
+	return EncodeChunk(encoded, label)
+}
+
+// Labels the graph with the public key and encodes
+// data with the last layer labels in a new plot file
+func CreateReplica(path string, id int, pub crypto.PubKeyEd25519, spec *graph.Spec, data []byte) (*Plot, error) {
+	if !replicaSpec(spec) {
+		return nil, ErrReplicaSpec
+	}
+	if size := int64(len(data)); size == 0 || size > ReplicaCapacity(spec) {
+		return nil, ErrDataSize
+	}
+	return createPlot(path, id, pub, spec, data)
+}
+
+func (header *PlotHeader) validateReplica() error {
+	switch {
+	case !replicaSpec(header.Graph),
+		header.NumChunks > header.Graph.LastLayerSize(),
+		header.NumChunks != numChunks(header.DataSize),
+		len(header.ReplicaCommit) != HASH_SIZE:
+		return ErrPlotHeader
+	}
+	return nil
+}
+
+// Idx of the label that encodes chunk i
+func (header *PlotHeader) chunkLabel(i int64) int64 {
+	return header.NumLabels - header.Graph.LastLayerSize() + i
+}
+
+func (plot *Plot) IsReplica() bool {
+	return plot.replica != nil
+}
+
+// Whether the label slot holds an encoded chunk
+func (plot *Plot) encodes(idx int64) bool {
+	if plot.replica == nil {
+		return false
+	}
+	first := plot.header.chunkLabel(0)
+	return idx >= first && idx < first+plot.header.NumChunks
+}
+
+// Leaves are the label slots of the encoded chunks
+func newReplicaTree(file *os.File, header *PlotHeader) *plotTree {
+	tree := newPlotTree(file, PLOT_HEADER_SIZE+header.chunkLabel(0)*HASH_SIZE, header.NumChunks)
+	tree.nodes = header.parentsEnd()
+	return tree
+}
+
+func (plot *Plot) initReplica(data []byte) {
+	header := plot.header
+	header.DataSize = int64(len(data))
+	header.NumChunks = numChunks(header.DataSize)
+	header.ReplicaCommit = make([]byte, HASH_SIZE)
+	plot.replica = newReplicaTree(plot.file, header)
+}
+
+func (plot *Plot) encode(data []byte) error {
+	header := plot.header
+	chunk := make([]byte, HASH_SIZE)
+	for i := int64(0); i < header.NumChunks; i++ {
+		for j := range chunk {
+			chunk[j] = 0
+		}
+		copy(chunk, data[i*HASH_SIZE:])
+		label, err := plot.Label(header.chunkLabel(i))
+		if err != nil {
+			return err
+		}
+		if _, err = plot.file.WriteAt(EncodeChunk(chunk, label), plot.replica.leafOffset(i)); err != nil {
+			return err
+		}
+	}
+	if err := plot.replica.hashLevels(); err != nil {
+		return err
+	}
+	root, err := plot.replica.node(1)
+	if err != nil {
+		return err
+	}
+	header.ReplicaCommit = root
+	return nil
+}
+
+func (plot *Plot) EncodedChunk(i int64) ([]byte, error) {
+	if plot.replica == nil {
+		return nil, ErrNotReplica
+	}
+	return plot.replica.leaf(i)
+}
+
+// Recovers the original data from the plot
+func (plot *Plot) Decode() ([]byte, error) {
+	if plot.replica == nil {
+		return nil, ErrNotReplica
+	}
+	header := plot.header
+	data := make([]byte, 0, header.NumChunks*HASH_SIZE)
+	for i := int64(0); i < header.NumChunks; i++ {
+		encoded, err := plot.replica.leaf(i)
+		if err != nil {
+			return nil, err
+		}
+		label, err := plot.Label(header.chunkLabel(i))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, DecodeChunk(encoded, label)...)
+	}
+	return data[:header.DataSize], nil
+}
+
+// Each challenged chunk is answered with the encoded chunk
+// and the label it was encoded with, each with a merkle proof
+
+type ReplicaProof struct {
+	ChunkProofs   []*merkle.Proof      `json:"chunk_proofs"`
+	Commit        []byte               `json:"commit"`
+	LabelProofs   []*merkle.Proof      `json:"label_proofs"`
+	PubKey        crypto.PubKeyEd25519 `json:"public_key"`
+	ReplicaCommit []byte               `json:"replica_commit"`
+	Seed          []byte               `json:"seed"`
+	Size          int64                `json:"size"`
+}
+
+// Decoded chunks in the proof
+func (replicaProof *ReplicaProof) Chunks() [][]byte {
+	chunks := make([][]byte, len(replicaProof.ChunkProofs))
+	for i, p := range replicaProof.ChunkProofs {
+		chunks[i] = DecodeChunk(p.Value, replicaProof.LabelProofs[i].Value)
+	}
+	return chunks
+}
+
+func (plot *Plot) ProveReplica(challenges []int64) (*ReplicaProof, error) {
+	if plot.replica == nil {
+		return nil, ErrNotReplica
+	}
+	header := plot.header
+	replicaProof := &ReplicaProof{
+		ChunkProofs:   make([]*merkle.Proof, len(challenges)),
+		Commit:        header.Commit,
+		LabelProofs:   make([]*merkle.Proof, len(challenges)),
+		PubKey:        header.PubKey,
+		ReplicaCommit: header.ReplicaCommit,
+		Size:          header.NumLabels,
+	}
+	var err error
+	for i, c := range challenges {
+		if replicaProof.ChunkProofs[i], err = plot.replica.computeProof(c); err != nil {
+			return nil, err
+		}
+		if replicaProof.LabelProofs[i], err = plot.ComputeProof(header.chunkLabel(c)); err != nil {
+			return nil, err
+		}
+	}
+	return replicaProof, nil
+}
+
+// Non-interactive replica proof
+func (plot *Plot) ProveReplicaNI(seed []byte, params *Params) (*ReplicaProof, error) {
+	if plot.replica == nil {
+		return nil, ErrNotReplica
+	}
+	header := plot.header
+	challenges := DeriveChallenges(header.ReplicaCommit, header.PubKey, seed, params.Beta, header.NumChunks)
+	replicaProof, err := plot.ProveReplica(challenges)
+	if err != nil {
+		return nil, err
+	}
+	replicaProof.Seed = seed
+	return replicaProof, nil
+}
+
+// The verifier knows the number of chunks from the data size
+func VerifyReplicaProof(commit, replicaCommit []byte, numChunks int64, replicaProof *ReplicaProof, params *Params) error {
+	pub, seed := replicaProof.PubKey, replicaProof.Seed
+	if err := checkProof(commit, pub, seed, replicaProof.Size, params); err != nil {
+		return err
+	}
+	if len(replicaCommit) != HASH_SIZE || numChunks < 1 || numChunks > params.Graph.LastLayerSize() {
+		return ErrIncorrectSize
+	}
+	if !bytes.Equal(replicaProof.Commit, commit) || !bytes.Equal(replicaProof.ReplicaCommit, replicaCommit) {
+		return ErrIncorrectCommit
+	}
+	challenges := DeriveChallenges(replicaCommit, pub, seed, params.Beta, numChunks)
+	if len(replicaProof.ChunkProofs) != len(challenges) || len(replicaProof.LabelProofs) != len(challenges) {
+		return ErrIncorrectNumProofs
+	}
+	first := replicaProof.Size - params.Graph.LastLayerSize()
+	for i, c := range challenges {
+		chunkProof, labelProof := replicaProof.ChunkProofs[i], replicaProof.LabelProofs[i]
+		if chunkProof == nil || labelProof == nil {
+			return ErrNotVerified
+		} else if chunkProof.Idx != c || labelProof.Idx != first+c {
+			return ErrIncorrectIdx
+		} else if !merkle.VerifyProof(chunkProof, replicaCommit) || !merkle.VerifyProof(labelProof, commit) {
+			return ErrNotVerified
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/graph"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"sync"
+)
+
+// A sector is one plot of space: a graph labelled
+// with the prover's public key and the merkle tree
+// committing to its values. Each sector has its own
+// graph id, tree and commitment.
+
+// Where a sector's labels and merkle nodes are kept
+type store interface {
+	Close() error
+	cacheLevels(levels int) error
+	cacheStats() *merkle.CacheStats
+	computeProof(idx int64) *merkle.Proof
+	parents(idx int64) Int64s
+	size() int64
+}
+
+type Sector struct {
+	Commit      []byte //merkle root hash
+	Id          int
+	mtx         sync.Mutex
+	params      *Params
+	precomputed *SpaceProof
+	proofStats  merkle.CacheStats
+	pub         crypto.PubKeyEd25519
+	store       store
+}
+
+func (s *Sector) String() string {
+	return Sprintf("SECTOR(id=%d,commit=%x,size=%d)", s.Id, s.Commit, s.Size())
+}
+
+func (s *Sector) Close() error {
+	return s.store.Close()
+}
+
+func (s *Sector) PubKey() crypto.PubKeyEd25519 {
+	return s.pub
+}
+
+func (s *Sector) Params() *Params {
+	return s.params
+}
+
+func (s *Sector) Size() int64 {
+	return s.store.size()
+}
+
+// Caches the top levels of the sector's merkle tree
+func (s *Sector) CacheLevels(levels int) error {
+	return s.store.cacheLevels(levels)
+}
+
+// Cache hits and misses for merkle nodes and precomputed proofs
+
+type ProverStats struct {
+	Nodes  *merkle.CacheStats `json:"nodes"`
+	Proofs *merkle.CacheStats `json:"proofs"`
+}
+
+func (stats *ProverStats) String() string {
+	return Sprintf("PROVER_STATS(nodes=%v,proofs=%v)", stats.Nodes, stats.Proofs)
+}
+
+func (s *Sector) Stats() *ProverStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	proofStats := s.proofStats
+	return &ProverStats{
+		Nodes:  s.store.cacheStats(),
+		Proofs: &proofStats,
+	}
+}
+
+// Sector kept in the graph and tree leveldbs
+
+type dbStore struct {
+	graph *graph.Graph
+	tree  *merkle.Tree
+}
+
+func (db *dbStore) Close() error {
+	if err := db.tree.Close(); err != nil {
+		return err
+	}
+	return db.graph.Close()
+}
+
+// (1) Set graph values
+// (2) Add leaves to merkle tree
+// (3) Hash levels of merkle tree
+func (db *dbStore) makeCommit(pub crypto.PubKeyEd25519, workers int) []byte {
+	db.graph.SetValues(pub)
+	leaf := func(idx int64) []byte {
+		return db.graph.Get(idx).Value
+	}
+	db.tree.MustBuild(db.graph.Size(), leaf, workers)
+	return db.tree.Root()
+}
+
+// The last node's sibling is padding when graph size is odd
+func (db *dbStore) computeProof(idx int64) *merkle.Proof {
+	var sibling []byte
+	if idx^1 < db.graph.Size() {
+		sibling = db.graph.Get(idx ^ 1).Value
+	}
+	nd := db.graph.Get(idx)
+	return db.tree.ComputeProof(idx, sibling, nd.Value)
+}
+
+func (db *dbStore) cacheLevels(levels int) error {
+	return db.tree.CacheLevels(levels)
+}
+
+func (db *dbStore) cacheStats() *merkle.CacheStats {
+	return db.tree.CacheStats()
+}
+
+func (db *dbStore) parents(idx int64) Int64s {
+	return db.graph.GetParents(idx)
+}
+
+func (db *dbStore) size() int64 {
+	return db.graph.Size()
+}
+
+// Sector kept in a plot file
+
+func (plot *Plot) computeProof(idx int64) *merkle.Proof {
+	p, err := plot.ComputeProof(idx)
+	Check(err)
+	return p
+}
+
+func (plot *Plot) cacheLevels(levels int) error {
+	return plot.labels.cacheLevels(levels)
+}
+
+func (plot *Plot) cacheStats() *merkle.CacheStats {
+	return plot.labels.cache.Stats()
+}
+
+func (plot *Plot) parents(idx int64) Int64s {
+	parents, err := plot.Parents(idx)
+	Check(err)
+	return parents
+}
+
+func (plot *Plot) size() int64 {
+	return plot.header.NumLabels
+}
+
+func (s *Sector) NewCommitProof(parentProofs [][]*merkle.Proof, proofs []*merkle.Proof) *CommitProof {
+	return &CommitProof{
+		Commit:       s.Commit,
+		Id:           s.Id,
+		ParentProofs: parentProofs,
+		Proofs:       proofs,
+		PubKey:       s.pub,
+		Size:         s.Size(),
+	}
+}
+
+func (s *Sector) ProveCommit(challenges []int64) *CommitProof {
+	var parents Int64s
+	proofs := make([]*merkle.Proof, len(challenges))
+	parentProofs := make([][]*merkle.Proof, len(challenges))
+	for i, c := range challenges {
+		proofs[i] = s.store.computeProof(c)
+		parents = s.store.parents(c)
+		if len(parents) > 0 {
+			parentProofs[i] = make([]*merkle.Proof, len(parents))
+			for j, parent := range parents { //should be sorted
+				parentProofs[i][j] = s.store.computeProof(parent)
+			}
+		}
+	}
+	return s.NewCommitProof(parentProofs, proofs)
+}
+
+// Non-interactive commit proof
+func (s *Sector) ProveCommitNI(seed []byte) *CommitProof {
+	num := s.params.Alpha
+	challenges := DeriveChallenges(s.Commit, s.pub, seed, num, s.Size())
+	commitProof := s.ProveCommit(challenges)
+	commitProof.Seed = seed
+	return commitProof
+}
+
+func (s *Sector) NewSpaceProof(proofs []*merkle.Proof) *SpaceProof {
+	return &SpaceProof{
+		Commit: s.Commit,
+		Proofs: proofs,
+		PubKey: s.pub,
+		Size:   s.Size(),
+	}
+}
+
+func (s *Sector) ProveSpace(challenges []int64) *SpaceProof {
+	proofs := make([]*merkle.Proof, len(challenges))
+	for i, c := range challenges {
+		proofs[i] = s.store.computeProof(c)
+	}
+	return s.NewSpaceProof(proofs)
+}
+
+// Non-interactive space proof
+// Returns the precomputed proof if it has the same seed
+func (s *Sector) ProveSpaceNI(seed []byte) *SpaceProof {
+	s.mtx.Lock()
+	if spaceProof := s.precomputed; spaceProof != nil && bytes.Equal(spaceProof.Seed, seed) {
+		s.precomputed = nil
+		s.proofStats.Hits++
+		s.mtx.Unlock()
+		return spaceProof
+	}
+	s.proofStats.Misses++
+	s.mtx.Unlock()
+	return s.proveSpaceNI(seed)
+}
+
+// Computes the space proof for a seed before it is
+// requested, e.g. once the next round's seed is known
+func (s *Sector) PrecomputeSpace(seed []byte) {
+	spaceProof := s.proveSpaceNI(seed)
+	s.mtx.Lock()
+	s.precomputed = spaceProof
+	s.mtx.Unlock()
+}
+
+func (s *Sector) proveSpaceNI(seed []byte) *SpaceProof {
+	num := s.params.Beta
+	challenges := DeriveChallenges(s.Commit, s.pub, seed, num, s.Size())
+	spaceProof := s.ProveSpace(challenges)
+	spaceProof.Seed = seed
+	return spaceProof
+}
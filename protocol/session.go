@@ -0,0 +1,231 @@
+package protocol
+
+import (
+	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/merkle"
+	. "github.com/zbo14/pos/util"
+	"time"
+)
+
+// A session tracks one prover's commit through the protocol
+// (1) Verifier receives commit -> COMMITTED
+// (2) Verifier sends commit challenges -> COMMIT_CHALLENGED,
+//     verifies commit proof -> COMMIT_VERIFIED
+// (3) Verifier sends space challenges -> SPACE_CHALLENGED
+// (4) Verifier verifies space proof -> SPACE_VERIFIED
+// Steps (3) and (4) can be repeated for later rounds
+// In non-interactive mode, challenges are derived from the
+// seed in the proof, so (2) and (4) take only the proof
+// Commit challenges are sent once per session, so a prover
+// cannot have them redrawn until it gets a convenient set
+// A response to space challenges after the deadline in params
+// is rejected, and new challenges must be sent
+
+type SessionState int
+
+const (
+	COMMITTED SessionState = iota
+	COMMIT_CHALLENGED
+	COMMIT_VERIFIED
+	SPACE_CHALLENGED
+	SPACE_VERIFIED
+)
+
+func (state SessionState) String() string {
+	switch state {
+	case COMMITTED:
+		return "committed"
+	case COMMIT_CHALLENGED:
+		return "commit_challenged"
+	case COMMIT_VERIFIED:
+		return "commit_verified"
+	case SPACE_CHALLENGED:
+		return "space_challenged"
+	case SPACE_VERIFIED:
+		return "space_verified"
+	default:
+		return Sprintf("unknown(%d)", int(state))
+	}
+}
+
+var ErrNoChallenges = Error("Challenges have not been sent")
+
+type ErrOutOfOrder struct {
+	Expected []SessionState
+	State    SessionState
+	Step     string
+}
+
+func (err *ErrOutOfOrder) Error() string {
+	return Sprintf("Cannot %s in state=%v; expected state in %v", err.Step, err.State, err.Expected)
+}
+
+// Prover took too long to respond to space challenges,
+// it may be recomputing labels instead of storing them
+type ErrDeadlineExceeded struct {
+	Deadline time.Duration
+	Elapsed  time.Duration
+}
+
+func (err *ErrDeadlineExceeded) Error() string {
+	return Sprintf("Response took %v; deadline is %v", err.Elapsed, err.Deadline)
+}
+
+type Session struct {
+	commit           []byte
+	commitChallenges Int64s
+	issued           time.Time
+	pub              crypto.PubKeyEd25519
+	spaceChallenges  Int64s
+	state            SessionState
+	verifier         *Verifier
+}
+
+// (1)
+
+func (v *Verifier) NewSession(commit []byte, pub crypto.PubKeyEd25519) (*Session, error) {
+	if size := len(commit); size != HASH_SIZE {
+		return nil, ErrIncorrectSize
+	}
+	return &Session{
+		commit:   commit,
+		pub:      pub,
+		state:    COMMITTED,
+		verifier: v,
+	}, nil
+}
+
+func (s *Session) Commit() []byte {
+	return s.commit
+}
+
+func (s *Session) PubKey() crypto.PubKeyEd25519 {
+	return s.pub
+}
+
+func (s *Session) State() SessionState {
+	return s.state
+}
+
+// When the last space challenges were sent
+func (s *Session) Issued() time.Time {
+	return s.issued
+}
+
+func (s *Session) checkDeadline() error {
+	deadline := s.verifier.params.Deadline
+	if deadline <= 0 {
+		return nil
+	}
+	if elapsed := s.verifier.now().Sub(s.issued); elapsed > deadline {
+		s.spaceChallenges = nil
+		s.state = COMMIT_VERIFIED
+		return &ErrDeadlineExceeded{
+			Deadline: deadline,
+			Elapsed:  elapsed,
+		}
+	}
+	return nil
+}
+
+func (s *Session) checkState(step string, expected ...SessionState) error {
+	for _, state := range expected {
+		if s.state == state {
+			return nil
+		}
+	}
+	return &ErrOutOfOrder{
+		Expected: expected,
+		State:    s.state,
+		Step:     step,
+	}
+}
+
+// (2)
+
+func (s *Session) CommitChallenges(seed []byte) (Int64s, error) {
+	if err := s.checkState("send commit challenges", COMMITTED); err != nil {
+		return nil, err
+	}
+	challenges, err := s.verifier.CommitChallenges(seed)
+	if err != nil {
+		return nil, err
+	}
+	s.commitChallenges = challenges
+	s.state = COMMIT_CHALLENGED
+	return challenges, nil
+}
+
+func (s *Session) VerifyCommit(commitProof *CommitProof) error {
+	if s.state == COMMITTED {
+		return ErrNoChallenges
+	}
+	if err := s.checkState("verify commit", COMMIT_CHALLENGED); err != nil {
+		return err
+	}
+	if err := verifyCommit(s.commit, s.pub, s.commitChallenges, commitProof, s.verifier.params); err != nil {
+		return err
+	}
+	s.state = COMMIT_VERIFIED
+	return nil
+}
+
+func (s *Session) VerifyCommitNI(commitProof *CommitProof) error {
+	if err := s.checkState("verify commit", COMMITTED); err != nil {
+		return err
+	}
+	if commitProof.PubKey != s.pub {
+		return ErrIncorrectPubKey
+	}
+	if err := VerifyCommitProof(s.commit, commitProof, s.verifier.params); err != nil {
+		return err
+	}
+	s.state = COMMIT_VERIFIED
+	return nil
+}
+
+// (3)
+
+func (s *Session) SpaceChallenges(seed []byte) (Int64s, error) {
+	if err := s.checkState("send space challenges", COMMIT_VERIFIED, SPACE_VERIFIED); err != nil {
+		return nil, err
+	}
+	challenges, err := s.verifier.SpaceChallenges(seed)
+	if err != nil {
+		return nil, err
+	}
+	s.issued = s.verifier.now()
+	s.spaceChallenges = challenges
+	s.state = SPACE_CHALLENGED
+	return challenges, nil
+}
+
+// (4)
+
+func (s *Session) VerifySpace(spaceProof *SpaceProof) error {
+	if err := s.checkState("verify space", SPACE_CHALLENGED); err != nil {
+		return err
+	}
+	if err := s.checkDeadline(); err != nil {
+		return err
+	}
+	if err := verifySpace(s.commit, s.spaceChallenges, s.verifier.params.GraphSize(), spaceProof, merkle.VerifyProof); err != nil {
+		return err
+	}
+	s.state = SPACE_VERIFIED
+	return nil
+}
+
+func (s *Session) VerifySpaceNI(spaceProof *SpaceProof) error {
+	if err := s.checkState("verify space", COMMIT_VERIFIED, SPACE_VERIFIED); err != nil {
+		return err
+	}
+	if spaceProof.PubKey != s.pub {
+		return ErrIncorrectPubKey
+	}
+	if err := VerifySpaceProof(s.commit, spaceProof, s.verifier.params); err != nil {
+		return err
+	}
+	s.state = SPACE_VERIFIED
+	return nil
+}
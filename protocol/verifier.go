@@ -5,40 +5,47 @@ import (
 	"encoding/binary"
 	// "github.com/zbo14/pos/crypto/tndr"
 	"github.com/tendermint/go-crypto"
+	"github.com/zbo14/pos/graph"
 	"github.com/zbo14/pos/merkle"
 	. "github.com/zbo14/pos/util"
-)
-
-const (
-	ALPHA_MULT = 1     // what should these params be?
-	BETA_MULT  = 1     // ..
-	GRAPH_SIZE = 65536 // ..
-	SEED_SIZE  = 64
+	"sync"
+	"time"
 )
 
 var (
-	ErrIncorrectIdx       = Error("Proof has incorrect idx")
-	ErrIncorrectNumProofs = Error("Incorrect number of proofs")
-	ErrIncorrectSize      = Error("Incorrect size")
-	ErrIncorrectValue     = Error("Proof has incorrect value")
-	ErrNotVerified        = Error("Proof verification failed")
+	ErrCommitRegistered    = Error("Commit is registered with another public key")
+	ErrIncorrectBranch     = Error("Proof branch does not start at a leaf")
+	ErrIncorrectCommit     = Error("Proof has incorrect commit")
+	ErrIncorrectIdx        = Error("Proof has incorrect idx")
+	ErrIncorrectNumParents = Error("Incorrect number of parent proofs")
+	ErrIncorrectNumProofs  = Error("Incorrect number of proofs")
+	ErrIncorrectPubKey     = Error("Proof has incorrect public key")
+	ErrIncorrectSize       = Error("Incorrect size")
+	ErrIncorrectValue      = Error("Proof has incorrect value")
+	ErrInDegree            = Error("Graph spec does not fix the in-degree")
+	ErrNotVerified         = Error("Proof verification failed")
+	ErrParentOrder         = Error("Parent proofs are not in ascending idx order")
+	ErrUnknownCommit       = Error("Commit is not registered")
 )
 
+// Verifier holds the protocol parameters and
+// the registered commitments of all sectors,
+// per-prover state is kept in a Session
+
 type Verifier struct {
-	alpha, beta int
-	challenges  Int64s
-	commit      []byte
-	pub         crypto.PubKeyEd25519
-	graphSize   int64
+	commits   map[string]crypto.PubKeyEd25519
+	graphSize int64
+	mtx       sync.RWMutex
+	now       func() time.Time
+	params    *Params
 }
 
-func NewVerifier() *Verifier {
-	alpha := int(Log2(GRAPH_SIZE)) * ALPHA_MULT
-	beta := int(Log2(GRAPH_SIZE)) * BETA_MULT
+func NewVerifier(params *Params) *Verifier {
 	return &Verifier{
-		alpha:     alpha,
-		beta:      beta,
-		graphSize: GRAPH_SIZE,
+		commits:   make(map[string]crypto.PubKeyEd25519),
+		graphSize: params.GraphSize(),
+		now:       time.Now,
+		params:    params,
 	}
 }
 
@@ -46,29 +53,76 @@ func (v *Verifier) GraphSize() int64 {
 	return v.graphSize
 }
 
-// (1)
+func (v *Verifier) Params() *Params {
+	return v.params
+}
+
+// Registry of commitments
 
-func (v *Verifier) ReceiveCommit(commit []byte, pub crypto.PubKeyEd25519) error {
-	if size := len(commit); size != HASH_SIZE {
+func (v *Verifier) Register(commit []byte, pub crypto.PubKeyEd25519) error {
+	if len(commit) != HASH_SIZE {
 		return ErrIncorrectSize
 	}
-	v.commit = commit
-	v.pub = pub
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if registered, ok := v.commits[string(commit)]; ok && registered != pub {
+		return ErrCommitRegistered
+	}
+	v.commits[string(commit)] = pub
 	return nil
 }
 
+func (v *Verifier) Registered(commit []byte) (crypto.PubKeyEd25519, bool) {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	pub, ok := v.commits[string(commit)]
+	return pub, ok
+}
+
+func (v *Verifier) NumRegistered() int {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	return len(v.commits)
+}
+
+func (v *Verifier) checkRegistered(commit []byte, pub crypto.PubKeyEd25519) error {
+	registered, ok := v.Registered(commit)
+	if !ok {
+		return ErrUnknownCommit
+	} else if registered != pub {
+		return ErrIncorrectPubKey
+	}
+	return nil
+}
+
+// Verifies a proof against the registered commit it names
+
+func (v *Verifier) VerifyCommit(commitProof *CommitProof) error {
+	if err := v.checkRegistered(commitProof.Commit, commitProof.PubKey); err != nil {
+		return err
+	}
+	return VerifyCommitProof(commitProof.Commit, commitProof, v.params)
+}
+
+func (v *Verifier) VerifySpace(spaceProof *SpaceProof) error {
+	if err := v.checkRegistered(spaceProof.Commit, spaceProof.PubKey); err != nil {
+		return err
+	}
+	return VerifySpaceProof(spaceProof.Commit, spaceProof, v.params)
+}
+
 func (v *Verifier) CommitChallenges(seed []byte) (Int64s, error) {
-	if size := len(seed); size != SEED_SIZE {
+	if size := len(seed); size != v.params.SeedSize {
 		return nil, ErrIncorrectSize
 	}
-	return v.SampleChallenges(seed, v.alpha), nil
+	return v.SampleChallenges(seed, v.params.Alpha), nil
 }
 
 func (v *Verifier) SpaceChallenges(seed []byte) (Int64s, error) {
-	if size := len(seed); size != SEED_SIZE {
+	if size := len(seed); size != v.params.SeedSize {
 		return nil, ErrIncorrectSize
 	}
-	return v.SampleChallenges(seed, v.beta), nil
+	return v.SampleChallenges(seed, v.params.Beta), nil
 }
 
 func (v *Verifier) SampleChallenges(seed []byte, param int) Int64s {
@@ -82,39 +136,125 @@ func (v *Verifier) SampleChallenges(seed []byte, param int) Int64s {
 		}
 		challenges[i] = rand % v.graphSize
 	}
-	v.challenges = challenges
 	return challenges
 }
 
-// (2)
+// Non-interactive challenges (Fiat-Shamir)
+// challenge = hash(commit, pubkey, seed, round) mod graph size
 
-func (v *Verifier) VerifyCommit(commitProof *CommitProof) error {
-	if len(commitProof.Proofs) != v.alpha {
+func DeriveChallenges(commit []byte, pub crypto.PubKeyEd25519, seed []byte, num int, graphSize int64) Int64s {
+	challenges := make(Int64s, num)
+	hash := NewHash()
+	pkbz := pub.Bytes()
+	for i := range challenges {
+		hash.Reset()
+		hash.Write(commit)
+		hash.Write(pkbz)
+		hash.Write(seed)
+		hash.Write(Int64Bytes(int64(i)))
+		rand := binary.BigEndian.Uint64(hash.Sum(nil))
+		challenges[i] = int64(rand % uint64(graphSize))
+	}
+	return challenges
+}
+
+// Stateless verification
+// Challenges are derived from the seed in the proof,
+// so a proof can be verified given only the commit
+
+func checkProof(commit []byte, pub crypto.PubKeyEd25519, seed []byte, size int64, params *Params) error {
+	var zero crypto.PubKeyEd25519
+	if len(commit) != HASH_SIZE || len(seed) != params.SeedSize {
+		return ErrIncorrectSize
+	} else if size != params.GraphSize() {
+		return ErrIncorrectSize
+	} else if pub == zero {
+		return ErrIncorrectPubKey
+	}
+	return nil
+}
+
+// Leaves are padded to a power of 2 (at least 2), so a proof
+// of a label has a branch of exactly the tree height. A shorter
+// branch would prove an internal node as if it were a label.
+func treeHeight(size int64) int {
+	return int(Log2(plotNumNodes(size) + 1))
+}
+
+func checkLeaf(p *merkle.Proof, size int64) error {
+	height := treeHeight(size)
+	if len(p.Branch) != height || p.Pos != p.Idx+1<<uint(height) {
+		return ErrIncorrectBranch
+	}
+	return nil
+}
+
+func VerifyCommitProof(commit []byte, commitProof *CommitProof, params *Params) error {
+	pub, seed := commitProof.PubKey, commitProof.Seed
+	if err := checkProof(commit, pub, seed, commitProof.Size, params); err != nil {
+		return err
+	}
+	challenges := DeriveChallenges(commit, pub, seed, params.Alpha, commitProof.Size)
+	return verifyCommit(commit, pub, challenges, commitProof, params)
+}
+
+func VerifySpaceProof(commit []byte, spaceProof *SpaceProof, params *Params) error {
+	pub, seed := spaceProof.PubKey, spaceProof.Seed
+	if err := checkProof(commit, pub, seed, spaceProof.Size, params); err != nil {
+		return err
+	}
+	challenges := DeriveChallenges(commit, pub, seed, params.Beta, spaceProof.Size)
+	return verifySpace(commit, challenges, params.GraphSize(), spaceProof, merkle.VerifyProof)
+}
+
+// Each challenged label is recomputed from its parents the
+// same way Graph.SetValues does, so parent proofs must be in
+// ascending idx order without duplicates. All parents must be
+// included, so the graph spec must fix the in-degree.
+func verifyCommit(commit []byte, pub crypto.PubKeyEd25519, challenges Int64s, commitProof *CommitProof, params *Params) error {
+	spec, size := params.Graph, params.GraphSize()
+	if !spec.FixedInDegree() {
+		return ErrInDegree
+	} else if !bytes.Equal(commitProof.Commit, commit) {
+		return ErrIncorrectCommit
+	} else if commitProof.Size != size {
+		return ErrIncorrectSize
+	} else if len(commitProof.Proofs) != len(challenges) {
 		return ErrIncorrectNumProofs
-	} else if len(commitProof.ParentProofs) != v.alpha {
+	} else if len(commitProof.ParentProofs) != len(challenges) {
 		return ErrIncorrectNumProofs
 	}
-	hash := NewHash()
-	pkbz := v.pub.Bytes()
-	for i, c := range v.challenges {
-		value := append(pkbz, Int64Bytes(c)...)
+	for i, c := range challenges {
 		proof := commitProof.Proofs[i]
-		if proof.Idx != c {
+		if proof == nil {
+			return ErrNotVerified
+		} else if proof.Idx != c {
 			return ErrIncorrectIdx
-		} else if !merkle.VerifyProof(proof, v.commit) {
+		} else if err := checkLeaf(proof, size); err != nil {
+			return err
+		} else if !merkle.VerifyProof(proof, commit) {
 			return ErrNotVerified
 		}
-		for _, p := range commitProof.ParentProofs[i] {
-			if p.Idx >= c {
+		parentProofs := commitProof.ParentProofs[i]
+		if inDegree, _ := spec.InDegree(c); int64(len(parentProofs)) != inDegree {
+			return ErrIncorrectNumParents
+		}
+		values := make([][]byte, len(parentProofs))
+		for j, p := range parentProofs {
+			if p == nil {
+				return ErrNotVerified
+			} else if p.Idx >= c {
 				return ErrIncorrectIdx
-			} else if !merkle.VerifyProof(p, v.commit) {
+			} else if j > 0 && p.Idx <= parentProofs[j-1].Idx {
+				return ErrParentOrder
+			} else if err := checkLeaf(p, size); err != nil {
+				return err
+			} else if !merkle.VerifyProof(p, commit) {
 				return ErrNotVerified
 			}
-			value = append(value, p.Value...)
+			values[j] = p.Value
 		}
-		hash.Reset()
-		hash.Write(value)
-		value = hash.Sum(nil)
+		value := graph.Label(pub, commitProof.Id, c, values)
 		if !bytes.Equal(proof.Value, value) {
 			return ErrIncorrectValue
 		}
@@ -122,17 +262,23 @@ func (v *Verifier) VerifyCommit(commitProof *CommitProof) error {
 	return nil
 }
 
-// (3)
-
-func (v *Verifier) VerifySpace(spaceProof *SpaceProof) error {
-	if len(spaceProof.Proofs) != v.beta {
+func verifySpace(commit []byte, challenges Int64s, size int64, spaceProof *SpaceProof, verify func(*merkle.Proof, []byte) bool) error {
+	if !bytes.Equal(spaceProof.Commit, commit) {
+		return ErrIncorrectCommit
+	} else if spaceProof.Size != size {
+		return ErrIncorrectSize
+	} else if len(spaceProof.Proofs) != len(challenges) {
 		return ErrIncorrectNumProofs
 	}
-	for i, c := range v.challenges {
+	for i, c := range challenges {
 		proof := spaceProof.Proofs[i]
-		if proof.Idx != c {
+		if proof == nil {
+			return ErrNotVerified
+		} else if proof.Idx != c {
 			return ErrIncorrectIdx
-		} else if !merkle.VerifyProof(proof, v.commit) {
+		} else if err := checkLeaf(proof, size); err != nil {
+			return err
+		} else if !verify(proof, commit) {
 			return ErrNotVerified
 		}
 	}